@@ -1,40 +1,318 @@
 package main
 
 import (
-	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"hash/crc32"
+	"strings"
 )
 
+/* Chunk layouts
+ *
+ * Version 0 (legacy): 4 checksum bytes followed by the payload
+ * Version 1: 48 byte header followed by the payload
+ *   0..4    CHUNKMAGIC
+ *   4       layout version
+ *   8..16   chunk index (little endian)
+ *   16..24  chunk disk offset in bytes (little endian)
+ *   24..40  run ID
+ *   40..44  CRC32 over the chunk, excluding this field (little endian)
+ * Version 2: 80 byte header followed by the payload
+ *   0..40   same as version 1
+ *   5       hash type
+ *   6       flags (CHUNKFLAG_*)
+ *   40..44  sector size for CHUNKFLAG_SECTORSUMS (little endian)
+ *   48..80  digest over the chunk excluding this field, zero padded for shorter digests
+ *
+ * With CHUNKFLAG_SECTORSUMS, every sector of the chunk ends with the CRC32C of the preceding sector bytes
+ * (little endian). For the first sector, the checksum covers only the bytes after the header.
+ *
+ * The magic cannot occur in a version 0 chunk, as there the second checksum byte is always even.
+ */
+const CHUNKHEADER_V1 = 48
+const CHUNKHEADER_V2 = 80
+const CHUNKFLAG_SECTORSUMS = 1 // Per-sector checksums
+
+var CHUNKMAGIC = []byte{'d', 's', 'a', 'n'}
+
+var crc32q = crc32.MakeTable(0xD5828281)
+
 // Compute checksum of the given buffer
 func checksum(buf []byte) uint32 {
-	crc32q := crc32.MakeTable(0xD5828281)
 	return crc32.Checksum(buf, crc32q)
 }
 
+// Per-run ID, stored in the chunk headers to detect chunks from other runs
+type RunID [16]byte
+
+// Create a new random (version 4 UUID) run ID
+func NewRunID() RunID {
+	var id RunID
+	FillRandom(id[:])
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id
+}
+
+/* Derive the run ID (version 4 UUID) from the given run seed, so that a run replayed with the same seed writes the
+ * same chunk headers
+ */
+func SeedRunID(seed int64) RunID {
+	var id RunID
+	state := uint64(seed) ^ 0x72756e2d6964 // Not the state of the chunk pattern with the same seed
+	binary.LittleEndian.PutUint64(id[0:8], splitmix64(&state))
+	binary.LittleEndian.PutUint64(id[8:16], splitmix64(&state))
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id
+}
+
+func ParseRunID(str string) (RunID, error) {
+	var id RunID
+	buf, err := hex.DecodeString(strings.Replace(str, "-", "", -1))
+	if err != nil {
+		return id, err
+	}
+	if len(buf) != len(id) {
+		return id, fmt.Errorf("invalid run ID length")
+	}
+	copy(id[:], buf)
+	return id, nil
+}
+
+func (id RunID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// Chunk parameters of a run
+type ChunkParams struct {
+	Seed  int64    // Run seed (0 = random legacy chunks of older versions)
+	RunID RunID    // Run ID for the chunk headers
+	Hash  HashType // Digest algorithm (HASH_NONE = version 1 chunks)
+	// Size of the blocks with their own checksum (0 = no sector checksums). Requires a version 2 layout
+	SectorSize int
+	Pattern    []byte // Fixed pattern without header or nil, for the seeded random chunks
+	ChunkSize  int    // Chunk size of the run, for the chunk index
+}
+
+// Check if the chunks of the run can be rebuilt for a byte-exact comparison
+func (params ChunkParams) Reproducible() bool {
+	return params.Seed != 0 || params.Pattern != nil
+}
+
+// Decoded chunk header
+type ChunkHeader struct {
+	Version    int
+	Hash       HashType
+	SectorSize int // 0 if the chunk has no sector checksums
+	Index      int64
+	Offset     int64
+	RunID      RunID
+}
+
+// Get the header size of the given layout version
+func chunkHeaderSize(version int) int {
+	switch version {
+	case 0:
+		return 4
+	case 1:
+		return CHUNKHEADER_V1
+	default:
+		return CHUNKHEADER_V2
+	}
+}
+
+// Get the layout version of the given chunk
+func chunkVersion(buf []byte) int {
+	if len(buf) <= len(CHUNKMAGIC) {
+		return 0
+	}
+	for i := range CHUNKMAGIC {
+		if buf[i] != CHUNKMAGIC[i] {
+			return 0
+		}
+	}
+	version := int(buf[4])
+	if len(buf) < chunkHeaderSize(version) {
+		return 0
+	}
+	return version
+}
+
+// Checksum of a version 1 chunk
+func checksumV1(buf []byte) uint32 {
+	return crc32.Update(checksum(buf[:40]), crc32q, buf[44:])
+}
+
+// Digest of a version 2 chunk or nil, if the hash type is unknown
+func digestV2(buf []byte) []byte {
+	h := HashType(buf[5]).New()
+	if h == nil {
+		return nil
+	}
+	h.Write(buf[:48])
+	h.Write(buf[CHUNKHEADER_V2:])
+	return h.Sum(nil)
+}
+
 // Check if the given chunk is OK
 func VerifyChunk(buf []byte) bool {
-	cSum := checksum(buf[4:])
-	for i := 0; i < 4; i++ {
-		if buf[i] != byte(cSum<<i) {
+	switch chunkVersion(buf) {
+	case 0:
+		cSum := checksum(buf[4:])
+		for i := 0; i < 4; i++ {
+			if buf[i] != byte(cSum<<i) {
+				return false
+			}
+		}
+		return true
+	case 1:
+		return binary.LittleEndian.Uint32(buf[40:]) == checksumV1(buf)
+	case 2:
+		digest := digestV2(buf)
+		if digest == nil {
+			return false
+		}
+		field := buf[48:CHUNKHEADER_V2]
+		return bufCompare(field[:len(digest)], digest) && isZero(field[len(digest):])
+	default:
+		return false
+	}
+}
+
+// Decode the header of the given chunk. Returns false if the chunk has no header
+func ParseChunkHeader(buf []byte) (ChunkHeader, bool) {
+	var header ChunkHeader
+	header.Version = chunkVersion(buf)
+	if header.Version != 1 && header.Version != 2 {
+		return header, false
+	}
+	if header.Version == 2 {
+		header.Hash = HashType(buf[5])
+		if buf[6]&CHUNKFLAG_SECTORSUMS != 0 {
+			header.SectorSize = int(binary.LittleEndian.Uint32(buf[40:]))
+		}
+	}
+	header.Index = int64(binary.LittleEndian.Uint64(buf[8:]))
+	header.Offset = int64(binary.LittleEndian.Uint64(buf[16:]))
+	copy(header.RunID[:], buf[24:40])
+	return header, true
+}
+
+/* Create the chunk for the given disk offset.
+ * The chunk content is derived from the run seed and the offset. A seed of 0 denotes a run of an older version,
+ * in which case the chunk is filled with random data and uses the legacy layout.
+ * Chunks of a fixed pattern consist only of the pattern, they can only be verified by comparison.
+ */
+func CreateChunk(buf []byte, params ChunkParams, offset int64) {
+	if params.Pattern != nil {
+		FillFixed(buf, params.Pattern, offset)
+		return
+	}
+	if params.Seed == 0 {
+		FillRandom(buf[4:]) // don't waste the first four bytes, as they are anyways checksum
+		ApplyChecksum(buf)
+		return
+	}
+	FillPattern(buf, params.Seed, offset)
+	version := 2
+	if params.Hash == HASH_NONE {
+		version = 1
+	}
+	headerSize := chunkHeaderSize(version)
+	if len(buf) < headerSize { // Too small for a header
+		ApplyChecksum(buf)
+		return
+	}
+	copy(buf[0:4], CHUNKMAGIC)
+	buf[4] = byte(version)
+	buf[5], buf[6], buf[7] = byte(params.Hash), 0, 0
+	binary.LittleEndian.PutUint64(buf[8:], uint64(offset/int64(params.ChunkSize)))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(offset))
+	copy(buf[24:40], params.RunID[:])
+	for i := 40; i < headerSize; i++ {
+		buf[i] = 0
+	}
+	if version == 1 {
+		binary.LittleEndian.PutUint32(buf[40:], checksumV1(buf))
+	} else {
+		if params.SectorSize > 0 {
+			buf[6] |= CHUNKFLAG_SECTORSUMS
+			binary.LittleEndian.PutUint32(buf[40:], uint32(params.SectorSize))
+			for i := 0; i*params.SectorSize < len(buf); i++ {
+				if sector, ok := chunkSector(buf, params.SectorSize, i); ok {
+					binary.LittleEndian.PutUint32(sector[len(sector)-4:], crc32.Checksum(sector[:len(sector)-4], crc32c))
+				}
+			}
+		}
+		copy(buf[48:], digestV2(buf))
+	}
+}
+
+/* Get the checksummed bytes of the i-th sector of a chunk, including the trailing checksum.
+ * Returns false if the sector is too small to hold a checksum
+ */
+func chunkSector(buf []byte, sectorSize int, i int) ([]byte, bool) {
+	start := i * sectorSize
+	end := start + sectorSize
+	if end > len(buf) {
+		end = len(buf)
+	}
+	if i == 0 {
+		start = CHUNKHEADER_V2
+	}
+	if end-start <= 4 {
+		return nil, false
+	}
+	return buf[start:end], true
+}
+
+/* Get the indices of all sectors of the given chunk whose sector checksum doesn't match.
+ * The sector size is taken from the run and not from the header, as the header itself might be corrupted.
+ * Returns nil if the run has no sector checksums
+ */
+func FailedSectors(buf []byte, sectorSize int) []int {
+	if sectorSize <= 0 {
+		return nil
+	}
+	failed := make([]int, 0)
+	for i := 0; i*sectorSize < len(buf); i++ {
+		if sector, ok := chunkSector(buf, sectorSize, i); ok {
+			if binary.LittleEndian.Uint32(sector[len(sector)-4:]) != crc32.Checksum(sector[:len(sector)-4], crc32c) {
+				failed = append(failed, i)
+			}
+		}
+	}
+	return failed
+}
+
+// Check if all bytes of the given buffer are zero
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
 			return false
 		}
 	}
 	return true
 }
 
-func CreateChunk(buf []byte) {
-	n, err := rand.Read(buf[4:]) // don't waste the first four bytes, as they are anyways checksum
-	if err != nil {
-		// This error is critical and cannot be recovered
-		panic(err)
+// Compare the given chunk against the expected chunk and return the indices of all differing bytes
+func DiffChunk(buf []byte, expected []byte) []int {
+	diff := make([]int, 0)
+	n := len(buf)
+	if len(expected) < n {
+		n = len(expected)
 	}
-	if n < len(buf)-4 {
-		panic(fmt.Errorf("couldn't get enough bytes from random pool"))
+	for i := 0; i < n; i++ {
+		if buf[i] != expected[i] {
+			diff = append(diff, i)
+		}
 	}
-	ApplyChecksum(buf)
+	return diff
 }
 
+// Apply the legacy (version 0) checksum to the chunk
 func ApplyChecksum(buf []byte) {
 	// Apply checksum to CHUNK at the beginning
 	cSum := checksum(buf[4:])
@@ -45,16 +323,29 @@ func ApplyChecksum(buf []byte) {
 
 // Factory for producing chunks
 type ChunkFactory struct {
-	buf     []byte   // destination buffer
-	sig     chan int // status channel
-	running bool     // Running flag
+	buf     []byte      // destination buffer
+	ready   chan int    // ready signal from the producer
+	sig     chan int    // status channel to the producer (0 = proceed, 1 = stop)
+	running bool        // Running flag
+	params  ChunkParams // chunk parameters of the run
+	pos     int64       // disk offset of the next chunk
+	last    int64       // disk offset of the chunk in the buffer
+	next    func(int64) int64
 }
 
-func (cf *ChunkFactory) StartProduce(size int) {
+/* Start producing chunks of the given size, beginning at the given disk offset. Chunks are aligned to their size,
+ * so an unaligned first chunk ends at the next multiple. The next function gets the offset behind a chunk and returns
+ * the offset of the next chunk to produce, nil produces consecutive chunks
+ */
+func (cf *ChunkFactory) StartProduce(size int, params ChunkParams, pos int64, next func(int64) int64) {
 	if cf.running {
 		return
 	}
 	cf.buf = make([]byte, size)
+	cf.params = params
+	cf.pos = pos
+	cf.next = next
+	cf.ready = make(chan int, 1)
 	cf.sig = make(chan int, 1)
 	cf.running = true
 	go cf.produce()
@@ -62,8 +353,13 @@ func (cf *ChunkFactory) StartProduce(size int) {
 
 func (cf *ChunkFactory) produce() {
 	for cf.running {
-		CreateChunk(cf.buf)
-		cf.sig <- 0        // Send ready signal
+		CreateChunk(cf.buf, cf.params, cf.pos)
+		cf.last = cf.pos
+		cf.pos += int64(len(cf.buf)) - cf.pos%int64(len(cf.buf))
+		if cf.next != nil {
+			cf.pos = cf.next(cf.pos)
+		}
+		cf.ready <- 0      // Send ready signal
 		if <-cf.sig != 0 { // Wait for signal to proceed
 			break // stop signal
 		}
@@ -79,13 +375,14 @@ func (cf *ChunkFactory) Read(buf []byte) error {
 		return fmt.Errorf("chunk factory buffer size mismatch")
 	}
 	// Wait for ready signal
-	if sig := <-cf.sig; sig != 0 {
+	if sig := <-cf.ready; sig != 0 {
 		return fmt.Errorf("chunk factory signal %d", sig)
 	}
-	copy(buf, cf.buf) // smaller buffer is allowed
-	// If it is a smaller buffer, we need to re-compute the checksum
+	// A smaller buffer is allowed, but then the chunk needs to be re-created for the smaller size
 	if len(cf.buf) != len(buf) {
-		ApplyChecksum(buf)
+		CreateChunk(buf, cf.params, cf.last)
+	} else {
+		copy(buf, cf.buf)
 	}
 	cf.sig <- 0
 	return nil
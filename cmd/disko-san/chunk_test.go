@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// Chunk layouts with their golden vectors
+var goldenChunks = []struct {
+	name       string
+	version    int
+	hash       HashType
+	sectorSize int
+	field      [2]int // position of the checksum field
+	value      string
+}{
+	{"v0", 0, HASH_NONE, 0, [2]int{0, 4}, "4a942850"},
+	{"v1", 1, HASH_NONE, 0, [2]int{40, 44}, "24d01ba0"},
+	{"v2/crc32c", 2, HASH_CRC32C, 0, [2]int{48, 52}, "5d64b547"},
+	{"v2/fnv64", 2, HASH_FNV64, 0, [2]int{48, 56}, "3f26823257219a77"},
+	{"v2/sha256", 2, HASH_SHA256, 0, [2]int{48, 80}, "b0e4eca5442efd09ab4d93b12d766e36cc395db48d02531e3bd2d4ac7f662e0e"},
+	{"v2/sectors", 2, HASH_CRC32C, 256, [2]int{252, 256}, "32c7381c"},
+}
+
+// Create a chunk of the given layout at the given disk offset with seed 0x1337 and run ID 00..0f
+func goldenChunk(buf []byte, version int, hash HashType, sectorSize int, offset int64) {
+	params := ChunkParams{Seed: 0x1337, Hash: hash, SectorSize: sectorSize, ChunkSize: DEFAULT_CHUNKSIZE}
+	for i := range params.RunID {
+		params.RunID[i] = byte(i)
+	}
+	if version == 0 {
+		FillPattern(buf, params.Seed, offset)
+		ApplyChecksum(buf)
+	} else {
+		CreateChunk(buf, params, offset)
+	}
+}
+
+/* Check the chunk layouts against the golden vectors, a 512 byte chunk at disk offset 2*DEFAULT_CHUNKSIZE. The vectors
+ * hold the checksum or digest field of each layout, for the sectors layout the checksum of the first 256 byte sector.
+ * This ensures that chunks remain verifiable across versions
+ */
+func TestGoldenChunks(t *testing.T) {
+	buf := make([]byte, 512)
+	for _, golden := range goldenChunks {
+		goldenChunk(buf, golden.version, golden.hash, golden.sectorSize, 2*DEFAULT_CHUNKSIZE)
+		if version := chunkVersion(buf); version != golden.version {
+			t.Errorf("%s: layout version %d, expected %d", golden.name, version, golden.version)
+		}
+		if !VerifyChunk(buf) {
+			t.Errorf("%s: verification failed", golden.name)
+		}
+		if failed := FailedSectors(buf, golden.sectorSize); len(failed) > 0 {
+			t.Errorf("%s: sector checksums %v failed", golden.name, failed)
+		}
+		if value := hex.EncodeToString(buf[golden.field[0]:golden.field[1]]); value != golden.value {
+			t.Errorf("%s: expected %s, got %s", golden.name, golden.value, value)
+		}
+	}
+}
+
+// The seeded pattern itself is part of the layout, as the read check rebuilds the expected chunks from it
+func TestGoldenPattern(t *testing.T) {
+	buf := make([]byte, 512)
+	goldenChunk(buf, 2, HASH_CRC32C, 0, 2*DEFAULT_CHUNKSIZE)
+	if value := hex.EncodeToString(buf[100:108]); value != "555fbdeeb866acec" {
+		t.Errorf("expected 555fbdeeb866acec, got %s", value)
+	}
+}
+
+// Chunks of every layout verify after writing them and fail after corrupting the payload or the header
+func TestChunkCorruption(t *testing.T) {
+	const sectorSize = 512
+	buf := make([]byte, 4096)
+	for _, golden := range goldenChunks {
+		sectors := 0
+		if golden.sectorSize != 0 {
+			sectors = sectorSize
+		}
+		goldenChunk(buf, golden.version, golden.hash, sectors, 3*DEFAULT_CHUNKSIZE)
+		if !VerifyChunk(buf) {
+			t.Errorf("%s: verification failed", golden.name)
+			continue
+		}
+
+		// Corrupt a byte in the fourth sector
+		buf[3*sectorSize+100]++
+		if VerifyChunk(buf) {
+			t.Errorf("%s: verification passed after corrupting the payload", golden.name)
+		}
+		if sectors != 0 {
+			if failed := FailedSectors(buf, sectors); !reflect.DeepEqual(failed, []int{3}) {
+				t.Errorf("%s: failed sectors %v, expected [3]", golden.name, failed)
+			}
+		}
+		buf[3*sectorSize+100]--
+		if !VerifyChunk(buf) {
+			t.Errorf("%s: verification failed after restoring the payload", golden.name)
+		}
+
+		// Corrupt the disk offset in the header. Version 0 chunks have no header, so the corruption hits the payload
+		buf[16]++
+		if VerifyChunk(buf) {
+			t.Errorf("%s: verification passed after corrupting the header", golden.name)
+		}
+		buf[16]--
+	}
+}
@@ -5,11 +5,18 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"unsafe"
 )
 
-const CHUNKSIZE = 4 * 1024 * 1024                                // Chunk size is 4 MB
+const DEFAULT_CHUNKSIZE = 4 * 1024 * 1024                        // Default chunk size is 4 MB
+const LBASIZE = 512                                              // Default logical block size, if the disk doesn't tell
+const DIRECT_ALIGNMENT = 4096                                    // Memory alignment for direct I/O buffers
 var DISKMAGIC = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 3, 3, 7} // DISK magic to make sure we are continuing on the right disk
 
+// Mount points of sysfs and procfs, configurable to test against fixture trees
+var SYSFS_ROOT = "/sys"
+var PROC_ROOT = "/proc"
+
 func isDiskMagic(buf []byte) bool {
 	n := len(DISKMAGIC)
 	if len(buf) < n {
@@ -24,9 +31,16 @@ func isDiskMagic(buf []byte) bool {
 }
 
 type Disk struct {
-	path string   // access path for disk
-	size int64    // disk size
-	f    *os.File // file handle for disk
+	path     string     // access path for disk
+	size     int64      // disk size
+	logical  int        // logical sector size
+	physical int        // physical sector size
+	geometry []Geometry // disk geometry of all sources, most reliable first
+	f        *os.File   // file handle for disk
+	flag     int        // access mode of the file handle
+	directIO bool       // f is opened for direct I/O, bypassing the page cache
+	direct   *os.File   // file handle for direct I/O reads in buffered mode, opened on demand
+	noDrop   bool       // dropping the page cache failed, so reads in buffered mode might hit the cache
 }
 
 func CreateDisk(path string) Disk {
@@ -34,18 +48,38 @@ func CreateDisk(path string) Disk {
 }
 
 func (d *Disk) Open() error {
+	return d.open(os.O_RDWR)
+}
+
+// Open the disk read-only, e.g. to inspect it
+func (d *Disk) OpenReadOnly() error {
+	return d.open(os.O_RDONLY)
+}
+
+func (d *Disk) open(flag int) error {
 	var err error
-	if d.f, err = os.OpenFile(d.path, os.O_RDWR, 0640); err != nil {
+	d.flag = flag
+	if d.f, err = os.OpenFile(d.path, flag, 0640); err != nil {
 		d.Close()
 		return err
 	}
-	if d.size, err = d.getDiskSize(); err != nil {
+	if d.geometry, err = d.getGeometry(); err != nil {
 		d.Close()
 		return err
 	}
+	// The first source is the most reliable one
+	d.size, d.logical, d.physical = d.geometry[0].Size, d.geometry[0].Logical, d.geometry[0].Physical
+	if d.size <= 0 || d.logical <= 0 || d.physical <= 0 {
+		d.Close()
+		return fmt.Errorf("invalid disk geometry (%s)", d.geometry[0])
+	}
 	return nil
 }
 func (d *Disk) Close() error {
+	if d.direct != nil {
+		d.direct.Close()
+		d.direct = nil
+	}
 	if d.f != nil {
 		err := d.f.Close()
 		d.f = nil
@@ -54,114 +88,248 @@ func (d *Disk) Close() error {
 	return nil
 }
 
-func (d *Disk) seekWhence(whence int) (int64, error) {
-	if d.f == nil {
-		return 0, fmt.Errorf("disk not opened")
-	}
-	return d.f.Seek(0, whence)
-}
-
-func (d *Disk) Seek(pos int64) error {
+/* Switch the disk to direct I/O, so that all reads and writes bypass the page cache and hit the media.
+ * Fails if direct I/O is not supported for the disk, e.g. for image files on some filesystems. The disk stays in
+ * buffered mode in this case
+ */
+func (d *Disk) EnableDirect() error {
 	if d.f == nil {
 		return fmt.Errorf("disk not opened")
 	}
-	if n, err := d.f.Seek(pos, 0); err != nil {
+	if d.directIO {
+		return nil
+	}
+	if d.size%int64(d.logical) != 0 {
+		return fmt.Errorf("disk size is not a multiple of the logical sector size")
+	}
+	f, err := d.openDirect(d.flag)
+	if err != nil {
 		return err
-	} else if n != pos {
-		fmt.Fprintf(os.Stderr, "Seek failed. Expected %d but got %d\n", pos, n)
-		return fmt.Errorf("seek failed")
 	}
+	// Some filesystems accept O_DIRECT when opening, but fail on the first access
+	buf := alignedBuffer(d.logical, DIRECT_ALIGNMENT)
+	if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		f.Close()
+		return err
+	}
+	d.f.Close()
+	d.f = f
+	d.directIO = true
 	return nil
 }
 
-// Get current position on disk
-func (d *Disk) Position() (int64, error) {
-	// First get current position so we can restore that later
-	return d.f.Seek(0, 1)
+// Check if the disk uses direct I/O
+func (d *Disk) IsDirect() bool {
+	return d.directIO
 }
 
 func (d *Disk) Size() int64 {
 	return d.size
 }
 
-func (d *Disk) getDiskSize() (int64, error) {
-	// determine size by seeking at the end of the file
-	var err error
-	var size int64
-	var pos int64
-	// First get current position so we can restore that later
-	if pos, err = d.Position(); err != nil {
-		return 0, err
+// Disk geometry as reported by the available sources, the most reliable first
+func (d *Disk) Geometry() []Geometry {
+	return d.geometry
+}
+
+// Describe all disagreements between the geometry sources
+func (d *Disk) GeometryWarnings() []string {
+	warnings := make([]string, 0)
+	for i := 1; i < len(d.geometry); i++ {
+		warnings = append(warnings, d.geometry[i].Disagreements(d.geometry[0])...)
 	}
-	if size, err = d.f.Seek(0, io.SeekEnd); err != nil {
-		return 0, err
+	return warnings
+}
+
+// Logical sector size, i.e. the smallest addressable unit of the disk
+func (d *Disk) LogicalSectorSize() int {
+	return d.logical
+}
+
+// Physical sector size, i.e. the smallest unit the disk can write without read-modify-write
+func (d *Disk) PhysicalSectorSize() int {
+	return d.physical
+}
+
+// Check if the given chunk size is usable for this disk
+func (d *Disk) CheckChunkSize(chunkSize int) error {
+	if chunkSize < CHUNKHEADER_V2 {
+		return fmt.Errorf("chunk size %d is smaller than the chunk header", chunkSize)
 	}
-	if _, err = d.f.Seek(0, io.SeekStart); err != nil {
-		return size, err
+	if chunkSize%d.logical != 0 {
+		return fmt.Errorf("chunk size %d is not a multiple of the logical sector size %d", chunkSize, d.logical)
 	}
-
-	// Restore position, if not at beginning
-	if pos != 0 {
-		if _, err = d.f.Seek(pos, io.SeekStart); err != nil {
-			return size, err
-		}
+	if chunkSize%d.physical != 0 {
+		return fmt.Errorf("chunk size %d is not a multiple of the physical sector size %d", chunkSize, d.physical)
 	}
+	return nil
+}
 
-	return size, nil
+/* Determine the size by seeking at the end of the file.
+ * All I/O is positional, so the file offset of the handle is never used otherwise
+ */
+func (d *Disk) getDiskSize() (int64, error) {
+	return d.f.Seek(0, io.SeekEnd)
 }
 
-// Check for magic bytes at the beginning of the disk
-func (d *Disk) CheckMagic() error {
+// Read the run header at the beginning of the disk
+func (d *Disk) ReadHeader() (DiskHeader, error) {
 	if d.f == nil {
-		return fmt.Errorf("disk not opened")
+		return DiskHeader{}, fmt.Errorf("disk not opened")
 	}
-	if off, err := d.seekWhence(io.SeekStart); err != nil {
-		return err
-	} else if off != 0 {
-		return fmt.Errorf("seek start failed (pos %d)", off)
+	size := DISKHEADER_SIZE
+	if d.logical > size {
+		size = d.logical
 	}
+	buf := alignedBuffer(size, DIRECT_ALIGNMENT)
+	if n, err := d.f.ReadAt(buf, 0); err == io.EOF && n < size {
+		return DiskHeader{}, fmt.Errorf("no disko-san header (disk too small)")
+	} else if err != nil && err != io.EOF {
+		return DiskHeader{}, err
+	}
+	return ParseDiskHeader(buf)
+}
 
-	// Read magic bytes at beginning
-	buf := make([]byte, CHUNKSIZE)
-	if n, err := d.f.Read(buf); err != nil {
+/* Check the run header at the beginning of the disk, i.e. in the first chunk, against the given run ID.
+ * A zero run ID (runs of older versions) is not checked
+ */
+func (d *Disk) CheckHeader(runID RunID) error {
+	header, err := d.ReadHeader()
+	if err != nil {
 		return err
-	} else if n != CHUNKSIZE {
-		return fmt.Errorf("cannot read full chunk")
 	}
-
-	if !isDiskMagic(buf) {
-		return fmt.Errorf("invalid disk magic")
+	if runID != (RunID{}) && header.Version == 0 {
+		return fmt.Errorf("the disk has no run header of run %s", runID)
+	} else if runID != (RunID{}) && header.RunID != runID {
+		return fmt.Errorf("the disk belongs to run %s, not to run %s", header.RunID, runID)
 	}
-
 	return nil
 }
 
 /* Prepare the disk for usage
- * This is already a destructive function as it writes the magic bytes to the beginning of the disk!
+ * This is already a destructive function as it writes the run header to the beginning of the disk!
  */
-func (d *Disk) Prepare() error {
+func (d *Disk) Prepare(header DiskHeader) error {
 	if d.f == nil {
 		return fmt.Errorf("disk not opened")
 	}
 
-	if _, err := d.f.Write(DISKMAGIC); err != nil {
+	// Write a full physical sector, as direct I/O cannot write less. The first chunk is reserved for the header anyways
+	size := DISKHEADER_SIZE
+	if d.physical > size {
+		size = d.physical
+	}
+	buf := alignedBuffer(size, DIRECT_ALIGNMENT)
+	header.Encode(buf)
+	if _, err := d.WriteAt(buf, 0); err != nil {
 		return err
 	}
 	return d.f.Sync()
 }
 
-/* Writes the given chunk
+// Allocate a buffer of the given size, whose start is aligned to the given alignment as required for direct I/O
+func alignedBuffer(size int, align int) []byte {
+	buf := make([]byte, size+align)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(align)); rem != 0 {
+		offset = align - rem
+	}
+	return buf[offset : offset+size]
+}
+
+// Check if the given buffer is not suited for direct I/O and needs to go through an aligned buffer
+func (d *Disk) unaligned(buf []byte) bool {
+	if !d.directIO || len(buf) == 0 {
+		return false
+	}
+	return uintptr(unsafe.Pointer(&buf[0]))%DIRECT_ALIGNMENT != 0 || len(buf)%d.logical != 0
+}
+
+// Open the handle for direct I/O reads, if not yet opened
+func (d *Disk) OpenDirect() error {
+	if d.directIO || d.direct != nil {
+		return nil
+	}
+	var err error
+	if d.direct, err = d.openDirect(os.O_RDONLY); err != nil {
+		d.direct = nil
+	}
+	return err
+}
+
+/* Read at the given position, bypassing the page cache with direct I/O.
+ * The position must be aligned to the logical sector size
+ */
+func (d *Disk) ReadDirect(buf []byte, pos int64) (int, error) {
+	if err := d.OpenDirect(); err != nil {
+		return 0, err
+	}
+	// Direct I/O requires aligned buffers and lengths of full sectors
+	size := (len(buf) + d.logical - 1) / d.logical * d.logical
+	tmp := alignedBuffer(size, DIRECT_ALIGNMENT)
+	f := d.direct
+	if d.directIO {
+		f = d.f
+	}
+	n, err := f.ReadAt(tmp, pos)
+	if n > len(buf) {
+		n = len(buf)
+	}
+	copy(buf, tmp[:n])
+	if err == io.EOF && n == len(buf) {
+		err = nil // Reading the rounded up length beyond the end of the disk
+	}
+	return n, err
+}
+
+/* Write the given chunk at the given position. Unaligned buffers go through an aligned buffer in direct I/O mode.
+ * The disk has no shared position, so concurrent calls for different positions don't interfere
  * Warning: This function does not check if the disk is opened!
  */
-func (d *Disk) Write(buf []byte) (int, error) {
-	return d.f.Write(buf)
+func (d *Disk) WriteAt(buf []byte, pos int64) (int, error) {
+	if d.unaligned(buf) {
+		if len(buf)%d.logical != 0 {
+			return 0, fmt.Errorf("direct I/O write of %d bytes is not a multiple of the sector size", len(buf))
+		}
+		tmp := alignedBuffer(len(buf), DIRECT_ALIGNMENT)
+		copy(tmp, buf)
+		return d.f.WriteAt(tmp, pos)
+	}
+	return d.f.WriteAt(buf, pos)
 }
 
-/* Reads at the current position
+/* Read into the given buffer from the given position. Unaligned buffers go through an aligned buffer in direct I/O mode.
+ * Like io.ReaderAt, a short read at the end of the disk returns io.EOF
  * Warning: This function does not check if the disk is opened!
  */
-func (d *Disk) Read(buf []byte) (int, error) {
-	return d.f.Read(buf)
+func (d *Disk) ReadAt(buf []byte, pos int64) (int, error) {
+	if d.unaligned(buf) {
+		size := (len(buf) + d.logical - 1) / d.logical * d.logical
+		tmp := alignedBuffer(size, DIRECT_ALIGNMENT)
+		n, err := d.f.ReadAt(tmp, pos)
+		if n > len(buf) {
+			n = len(buf)
+		}
+		copy(buf, tmp[:n])
+		if err == io.EOF && n == len(buf) {
+			err = nil // Reading the rounded up length beyond the end of the disk
+		}
+		return n, err
+	}
+	return d.f.ReadAt(buf, pos)
+}
+
+/* Drop the given range from the page cache in buffered mode, so that the following read hits the disk.
+ * If this is not supported, a warning is printed once and the page cache is not dropped anymore
+ */
+func (d *Disk) dropCacheBeforeRead(pos int64, length int64) {
+	if d.directIO || d.noDrop {
+		return
+	}
+	if err := d.DropCache(pos, length); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Cannot drop the page cache (%s), reads might not hit the disk\n", err)
+		d.noDrop = true
+	}
 }
 
 /* Performs a sync
@@ -0,0 +1,239 @@
+/* Linux specific disk handling for disko-san */
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// ioctl request numbers from linux/fs.h. They are _IO(0x12, nr), whose encoding depends on the platform
+var (
+	BLKFLSBUF  = iocNone(0x12, 97)
+	BLKDISCARD = iocNone(0x12, 119)
+	BLKSSZGET  = iocNone(0x12, 104)
+	BLKPBSZGET = iocNone(0x12, 123)
+)
+
+// BLKGETSIZE64 is _IOR(0x12, 114, size_t), whose encoding depends on the platform
+var BLKGETSIZE64 = iocRead(0x12, 114, unsafe.Sizeof(uintptr(0)))
+
+/* Get the position of the direction bits and the direction values for none and read of ioctl request numbers.
+ * mips, powerpc and sparc use 3 direction bits with their own values, all others the generic 2 bits
+ */
+func iocDir() (shift uint, none uintptr, read uintptr) {
+	for _, arch := range []string{"mips", "ppc", "sparc"} {
+		if strings.HasPrefix(runtime.GOARCH, arch) {
+			return 29, 1, 2
+		}
+	}
+	return 30, 0, 2
+}
+
+// Encode an ioctl request number without argument data, like _IO in linux/ioctl.h
+func iocNone(typ uintptr, nr uintptr) uintptr {
+	shift, none, _ := iocDir()
+	return none<<shift | typ<<8 | nr
+}
+
+// Encode an ioctl request number for reading a value of the given size, like _IOR in linux/ioctl.h
+func iocRead(typ uintptr, nr uintptr, size uintptr) uintptr {
+	shift, _, read := iocDir()
+	return read<<shift | size<<16 | typ<<8 | nr
+}
+
+// Perform an ioctl which returns an int value
+func ioctlInt(fd uintptr, req uintptr) (int, error) {
+	var value int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(&value))); errno != 0 {
+		return 0, errno
+	}
+	return int(value), nil
+}
+
+// Perform an ioctl which returns an uint64 value
+func ioctlUint64(fd uintptr, req uintptr) (uint64, error) {
+	var value uint64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(&value))); errno != 0 {
+		return 0, errno
+	}
+	return value, nil
+}
+
+// Check if the opened disk is a block device
+func (d *Disk) isBlockDevice() (bool, error) {
+	stat, err := d.f.Stat()
+	if err != nil {
+		return false, err
+	}
+	return stat.Mode()&os.ModeDevice != 0 && stat.Mode()&os.ModeCharDevice == 0, nil
+}
+
+/* Get the disk geometry from all available sources: The block device ioctls, sysfs and seeking to the end.
+ * Regular files only have their size and use 512 byte sectors
+ */
+func (d *Disk) getGeometry() ([]Geometry, error) {
+	size, err := d.getDiskSize()
+	if err != nil {
+		return nil, err
+	}
+	seek := Geometry{Source: "seek", Size: size}
+	if block, err := d.isBlockDevice(); err != nil {
+		return nil, err
+	} else if !block {
+		seek.Logical, seek.Physical = LBASIZE, LBASIZE
+		return []Geometry{seek}, nil
+	}
+
+	ioctl := Geometry{Source: "ioctl"}
+	if size, err := ioctlUint64(d.f.Fd(), BLKGETSIZE64); err != nil {
+		return nil, fmt.Errorf("BLKGETSIZE64: %s", err)
+	} else {
+		ioctl.Size = int64(size)
+	}
+	if ioctl.Logical, err = ioctlInt(d.f.Fd(), BLKSSZGET); err != nil {
+		return nil, fmt.Errorf("BLKSSZGET: %s", err)
+	}
+	if ioctl.Physical, err = ioctlInt(d.f.Fd(), BLKPBSZGET); err != nil {
+		return nil, fmt.Errorf("BLKPBSZGET: %s", err)
+	}
+	geometry := []Geometry{ioctl}
+	if sysfs, err := d.sysfsGeometry(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Cannot read the disk geometry from sysfs: %s\n", err)
+	} else {
+		geometry = append(geometry, sysfs)
+	}
+	return append(geometry, seek), nil
+}
+
+// Get the sysfs directory of the opened block device
+func (d *Disk) sysfsDir() (string, error) {
+	dev, err := d.devNumber()
+	if err != nil {
+		return "", err
+	}
+	return sysfsDevDir(dev)
+}
+
+// Get the device number of the disk as major:minor
+func (d *Disk) devNumber() (string, error) {
+	stat, err := d.f.Stat()
+	if err != nil {
+		return "", err
+	}
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("no device number")
+	}
+	dev := uint64(sys.Rdev)
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) & 0xfffff000)
+	minor := (dev & 0xff) | ((dev >> 12) & 0xffffff00)
+	return fmt.Sprintf("%d:%d", major, minor), nil
+}
+
+// Get the sysfs directory of the block device with the given device number (major:minor)
+func sysfsDevDir(dev string) (string, error) {
+	return filepath.EvalSymlinks(filepath.Join(SYSFS_ROOT, "dev", "block", dev))
+}
+
+// Read a numeric sysfs attribute
+func readSysfsInt(filename string) (int64, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+}
+
+// Get the disk geometry from sysfs. Partitions have no queue attributes, they are taken from the parent disk
+func (d *Disk) sysfsGeometry() (Geometry, error) {
+	geometry := Geometry{Source: "sysfs"}
+	dir, err := d.sysfsDir()
+	if err != nil {
+		return geometry, err
+	}
+	sectors, err := readSysfsInt(filepath.Join(dir, "size"))
+	if err != nil {
+		return geometry, err
+	}
+	geometry.Size = sectors * 512 // sysfs always counts 512 byte sectors
+	queue := filepath.Join(dir, "queue")
+	if !fileExists(queue) {
+		queue = filepath.Join(filepath.Dir(dir), "queue")
+	}
+	if value, err := readSysfsInt(filepath.Join(queue, "logical_block_size")); err != nil {
+		return geometry, err
+	} else {
+		geometry.Logical = int(value)
+	}
+	if value, err := readSysfsInt(filepath.Join(queue, "physical_block_size")); err != nil {
+		return geometry, err
+	} else {
+		geometry.Physical = int(value)
+	}
+	return geometry, nil
+}
+
+// Open the disk with the given access mode for direct I/O
+func (d *Disk) openDirect(flag int) (*os.File, error) {
+	return os.OpenFile(d.path, flag|syscall.O_DIRECT, 0640)
+}
+
+// Drop the given range of the disk from the page cache, so that the next read hits the media
+func (d *Disk) DropCache(pos int64, length int64) error {
+	if d.f == nil {
+		return fmt.Errorf("disk not opened")
+	}
+	return fadvise(d.f.Fd(), pos, length, FADV_DONTNEED)
+}
+
+/* Flush the disk and invalidate its cached data, so that the following reads hit the media.
+ * Block devices use BLKFLSBUF, which requires CAP_SYS_ADMIN. Regular files and unprivileged runs fall back to fadvise.
+ * Returns the used method
+ */
+func (d *Disk) InvalidateCache() (string, error) {
+	if d.f == nil {
+		return "", fmt.Errorf("disk not opened")
+	}
+	if err := d.f.Sync(); err != nil {
+		return "", err
+	}
+	if block, err := d.isBlockDevice(); err != nil {
+		return "", err
+	} else if block {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.f.Fd(), BLKFLSBUF, 0); errno == 0 {
+			return "BLKFLSBUF", nil
+		}
+	}
+	if err := fadvise(d.f.Fd(), 0, 0, FADV_DONTNEED); err != nil {
+		return "none", err
+	}
+	return "fadvise", nil
+}
+
+/* Discard the given range of the disk, i.e. tell the disk that the data is not needed anymore.
+ * Block devices use BLKDISCARD, regular files get the range punched out
+ */
+func (d *Disk) Discard(pos int64, length int64) error {
+	if d.f == nil {
+		return fmt.Errorf("disk not opened")
+	}
+	if block, err := d.isBlockDevice(); err != nil {
+		return err
+	} else if !block {
+		const FALLOC_FL_KEEP_SIZE = 0x01
+		const FALLOC_FL_PUNCH_HOLE = 0x02
+		return syscall.Fallocate(int(d.f.Fd()), FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE, pos, length)
+	}
+	r := [2]uint64{uint64(pos), uint64(length)}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.f.Fd(), BLKDISCARD, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+//go:build !linux
+// +build !linux
+
+/* Disk handling for disko-san on non-Linux systems */
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Get the disk geometry. Without geometry queries, the size is determined by seeking and 512 byte sectors are assumed
+func (d *Disk) getGeometry() ([]Geometry, error) {
+	size, err := d.getDiskSize()
+	if err != nil {
+		return nil, err
+	}
+	return []Geometry{{Source: "seek", Size: size, Logical: LBASIZE, Physical: LBASIZE}}, nil
+}
+
+// Direct I/O is not supported on this platform
+func (d *Disk) openDirect(flag int) (*os.File, error) {
+	return nil, fmt.Errorf("direct I/O not supported")
+}
+
+// Dropping the page cache is not supported on this platform
+func (d *Disk) DropCache(pos int64, length int64) error {
+	return fmt.Errorf("dropping the page cache is not supported")
+}
+
+// Flush the disk. Invalidating the cached data is not supported on this platform
+func (d *Disk) InvalidateCache() (string, error) {
+	if d.f == nil {
+		return "", fmt.Errorf("disk not opened")
+	}
+	if err := d.f.Sync(); err != nil {
+		return "", err
+	}
+	return "none", fmt.Errorf("cache invalidation is not supported")
+}
+
+// Checking if a disk is in use is not supported on this platform
+func (d *Disk) InUse() ([]string, error) {
+	return nil, nil
+}
+
+/* Get the identity of the disk for the confirmation before destructive writes. Without device queries, only the
+ * name, size and signatures are known. Returns false, if the disk is not a device, e.g. an image file
+ */
+func (d *Disk) Identity() (DiskIdentity, bool, error) {
+	id := DiskIdentity{Name: d.path, Size: d.size}
+	stat, err := d.f.Stat()
+	if err != nil || stat.Mode()&os.ModeDevice == 0 {
+		return id, false, err
+	}
+	if id.Signatures, err = d.readSignatures(0); err != nil {
+		return id, true, err
+	}
+	return id, true, nil
+}
+
+// Discarding is not supported on this platform
+func (d *Disk) Discard(pos int64, length int64) error {
+	return fmt.Errorf("discard is not supported")
+}
@@ -2,20 +2,48 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
 // Program configuration parameters
 type conf struct {
-	disk     string
-	progress string // Progress file for continue the job later on
-	stats    string // Performance log
-	verbose  bool
+	disk      string
+	progress  string        // Progress file for continue the job later on
+	stats     string        // Performance log
+	errors    string        // Errors file for failed chunks
+	seed      int64         // Run seed (0 = pick a random seed)
+	hash      HashType      // Chunk digest algorithm for new runs (HASH_NONE = default)
+	sectors   int           // Sector size for per-sector checksums of new runs (0 = disabled)
+	passes    []Pass        // Write/read passes of new runs (nil = a single random pass)
+	chunkSize int           // Chunk size of new runs (0 = default)
+	probe     bool          // Quick fake-capacity probe instead of the full test
+	budget    ErrorBudget   // Abort policy for bad chunks
+	retry     RetryPolicy   // Re-read policy for failed chunks
+	direct    bool          // Use direct I/O, if supported
+	inUse     bool          // Test the disk, even if it is in use
+	yes       bool          // Don't ask for confirmation before destroying the data on the disk
+	wipe      string        // Wipe mode after a successful test (empty = no wipe)
+	start     Offset        // Start of the tested range (0 = beginning of the disk)
+	end       Offset        // End of the tested range (0 = end of the disk)
+	sample    float64       // Percentage of the chunks to test in new runs (0 = all chunks)
+	readOnly  bool          // Read-only surface scan instead of the destructive test
+	preserve  bool          // Non-destructive read-write test, which preserves the original data
+	slow      time.Duration // Read time of slow chunks in the read-only scan (0 = relative to the average)
+	depth     int           // Queue depth of the write and read checks
+	badblocks string        // Export the bad blocks to this file
+	blockSize int64         // Block size of the bad blocks list
+	verbose   bool
 }
 
+var VERSION = "devel" // Program version, set at build time with -ldflags "-X main.VERSION=..."
+
 var cf conf
 var avg float32    // average for average smoothing
 var running bool   // running flag
@@ -26,6 +54,39 @@ func (cf *conf) CheckValid() error {
 	if cf.disk == "" {
 		return fmt.Errorf("missing disk file")
 	}
+	if cf.sectors != 0 {
+		// Sectors need to be a power of two, so that they align with the chunks
+		if cf.sectors < 512 || cf.sectors&(cf.sectors-1) != 0 {
+			return fmt.Errorf("invalid sector size %d (power of two of at least 512 required)", cf.sectors)
+		}
+	}
+	if cf.chunkSize < 0 {
+		return fmt.Errorf("invalid chunk size %d", cf.chunkSize)
+	}
+	if cf.sample < 0 || cf.sample > 100 {
+		return fmt.Errorf("invalid sample percentage %g", cf.sample)
+	}
+	if cf.readOnly && (cf.probe || cf.wipe != "" || cf.passes != nil) {
+		return fmt.Errorf("the read-only scan cannot be combined with --probe, --wipe or --patterns")
+	}
+	if cf.preserve && (cf.readOnly || cf.probe || cf.wipe != "") {
+		return fmt.Errorf("the non-destructive test cannot be combined with --read-only, --probe or --wipe")
+	}
+	if cf.preserve && cf.progress == "" {
+		return fmt.Errorf("the non-destructive test needs a PROGRESS file, as it keeps its journal next to it")
+	}
+	if cf.depth < 1 || cf.depth > QUEUE_MAX {
+		return fmt.Errorf("invalid queue depth %d (1 to %d)", cf.depth, QUEUE_MAX)
+	}
+	if cf.depth > 1 && (cf.readOnly || cf.preserve || cf.probe) {
+		return fmt.Errorf("the queue depth only applies to the destructive test and cannot be combined with --read-only, --non-destructive or --probe")
+	}
+	if passes := FormatPasses(cf.passes); len(passes) > DISKHEADER_PASSES {
+		return fmt.Errorf("the pass list is %d bytes long and doesn't fit into the run header (max. %d bytes)", len(passes), DISKHEADER_PASSES)
+	}
+	if cf.probe && (cf.start.Value != 0 || cf.end.Value != 0) {
+		return fmt.Errorf("the probe always covers the whole disk and cannot be limited to a range")
+	}
 	return nil
 }
 
@@ -69,6 +130,59 @@ func gibistr(bytes float32) string {
 	return fmt.Sprintf("%.2f B", bytes)
 }
 
+/* Parse a size in bytes with an optional binary unit suffix (K, M, G, T, P), e.g. "4M" or "512KiB" */
+func parseBytes(str string) (int64, error) {
+	units := "KMGTP"
+	str = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(str), "iB"), "B")
+	factor := int64(1)
+	if n := len(str); n > 0 {
+		if i := strings.IndexByte(units, strings.ToUpper(str)[n-1]); i >= 0 {
+			str = str[:n-1]
+			for j := 0; j <= i; j++ {
+				factor *= 1024
+			}
+		}
+	}
+	value, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return value * factor, nil
+}
+
+// Disk position given in bytes or as LBA
+type Offset struct {
+	Value int64
+	LBA   bool // Value is a LBA in units of the logical sector size
+}
+
+/* Parse a disk position in bytes with an optional binary unit suffix (e.g. "500G") or a LBA with the suffix 's'
+ * (e.g. "976773168s")
+ */
+func parseOffset(str string) (Offset, error) {
+	str = strings.TrimSpace(str)
+	if strings.HasSuffix(str, "s") {
+		value, err := strconv.ParseInt(strings.TrimSuffix(str, "s"), 10, 64)
+		if err == nil && value < 0 {
+			err = fmt.Errorf("negative LBA %d", value)
+		}
+		return Offset{Value: value, LBA: true}, err
+	}
+	value, err := parseBytes(str)
+	if err == nil && value < 0 {
+		err = fmt.Errorf("negative position %d", value)
+	}
+	return Offset{Value: value}, err
+}
+
+// Get the disk position in bytes
+func (o Offset) Bytes(lbaSize int) int64 {
+	if o.LBA {
+		return o.Value * int64(lbaSize)
+	}
+	return o.Value
+}
+
 func bufCompare(a []byte, b []byte) bool {
 	n := len(a)
 	if len(b) != n {
@@ -83,29 +197,32 @@ func bufCompare(a []byte, b []byte) bool {
 }
 
 /* Check the internal functions.
- * We write the first chunk and check if it verifies, then we corrupt it and check if the verification fails
+ * We write the first chunk of the tested range with the given size at the given position and check if it verifies,
+ * then we corrupt it and check if the verification fails. The chunk layouts are checked against their golden vectors
+ * in the tests
  */
-func CheckInternals(disk *Disk) error {
+func CheckInternals(disk *Disk, params ChunkParams, first int64, size int64) error {
 	var n int
 	var err error
-	chunk := make([]byte, CHUNKSIZE)
-
-	pos, err := disk.Position()
-	if err != nil {
-		return err
-	}
-	defer disk.Seek(pos) // Return original disk position at the end
+	chunkSize := int64(params.ChunkSize)
+	chunk := alignedBuffer(int(size), DIRECT_ALIGNMENT)
+	restore := params    // Chunk parameters for the chunk to restore at the end
+	params.Pattern = nil // Fixed patterns have no checksum, so the self test always uses the random chunks
 
-	if err = disk.Seek(CHUNKSIZE); err != nil {
-		return err
-	}
-	CreateChunk(chunk)
+	CreateChunk(chunk, params, first)
 	if !VerifyChunk(chunk) {
 		return fmt.Errorf("chunk verification function failed")
 	}
-	if n, err = disk.Write(chunk); err != nil {
+	if params.Seed != 0 {
+		if header, ok := ParseChunkHeader(chunk); !ok {
+			return fmt.Errorf("chunk header missing")
+		} else if header.Offset != first || header.Index != first/chunkSize || header.RunID != params.RunID {
+			return fmt.Errorf("chunk header mismatch")
+		}
+	}
+	if n, err = disk.WriteAt(chunk, first); err != nil {
 		return err
-	} else if n < CHUNKSIZE { // Suspicious: First trunk is already truncated?
+	} else if int64(n) < size { // Suspicious: First trunk is already truncated?
 		fmt.Fprintf(os.Stderr, "Warning: First chunk already truncated\n")
 		chunk = chunk[:n]
 	}
@@ -114,11 +231,8 @@ func CheckInternals(disk *Disk) error {
 	}
 
 	// Now read the chunk, it must be the same
-	buf := make([]byte, n)
-	if err := disk.Seek(CHUNKSIZE); err != nil { // Move back to where we wrote before
-		return err
-	}
-	if n, err := disk.Read(buf); err != nil {
+	buf := alignedBuffer(n, DIRECT_ALIGNMENT)
+	if n, err := disk.ReadAt(buf, first); err != nil {
 		return err
 	} else if n != len(buf) {
 		fmt.Fprintf(os.Stderr, "Read chunk size (%d) is not the same size as write chunk size (%d)\n", n, len(buf))
@@ -138,18 +252,12 @@ func CheckInternals(disk *Disk) error {
 	if VerifyChunk(chunk) {
 		return fmt.Errorf("chunk verification passed after corruption")
 	}
-	if err := disk.Seek(CHUNKSIZE); err != nil { // Move back to first chunk
-		return err
-	}
-	if n, err = disk.Write(chunk); err != nil {
+	if n, err = disk.WriteAt(chunk, first); err != nil {
 		return err
 	} else if n != len(chunk) { // This should never happen here again!!
 		return fmt.Errorf("write buffer decreased")
 	}
-	if err := disk.Seek(CHUNKSIZE); err != nil { // Move back to first chunk
-		return err
-	}
-	if n, err := disk.Read(buf); err != nil {
+	if n, err := disk.ReadAt(buf, first); err != nil {
 		return err
 	} else if n != len(buf) {
 		fmt.Fprintf(os.Stderr, "Read chunk size (%d) is not the same size as write chunk size (%d)\n", n, len(buf))
@@ -164,17 +272,14 @@ func CheckInternals(disk *Disk) error {
 		return fmt.Errorf("corrupted chunk reports valid verification")
 	}
 
-	// Important: Restore a valid chunk otherwise resume will fail because disk contains now a invalid chunk at position 1
-	CreateChunk(chunk)
-	if !VerifyChunk(chunk) {
+	// Important: Restore a valid chunk otherwise resume will fail because disk contains now a invalid chunk at the first position
+	CreateChunk(chunk, restore, first)
+	if restore.Pattern == nil && !VerifyChunk(chunk) {
 		return fmt.Errorf("chunk verification function failed")
 	}
-	if err := disk.Seek(CHUNKSIZE); err != nil { // Move back to first chunk
+	if n, err = disk.WriteAt(chunk, first); err != nil {
 		return err
-	}
-	if n, err = disk.Write(chunk); err != nil {
-		return err
-	} else if n < CHUNKSIZE { // Suspicious: First trunk is already truncated?
+	} else if int64(n) < size { // Suspicious: First trunk is already truncated?
 		fmt.Fprintf(os.Stderr, "Warning: First chunk already truncated\n")
 		chunk = chunk[:n]
 	}
@@ -185,159 +290,392 @@ func CheckInternals(disk *Disk) error {
 	return nil
 }
 
-/* Do the write check*/
-func WriteCheck(disk *Disk, progress *Progress, statsFile string) error {
-	var stats *os.File // stats file, if present
-	chunk := make([]byte, CHUNKSIZE)
+/* Do the write check with the given queue depth. The throughput is accounted to the given queue stats */
+func WriteCheck(disk *Disk, progress *Progress, statsFile string, depth int, qstats *QueueStats) error {
+	chunkSize := int64(progress.ChunkSize)
 
-	if statsFile != "" {
-		var err error
-		exists := fileExists(statsFile)
-		stats, err = os.OpenFile(statsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
-		if err != nil {
-			return fmt.Errorf("Error opening stats file : %s", err)
-		}
-		// Write stats file header only once
-		if !exists {
-			if _, err := stats.Write([]byte("# disko-san performance metrics file\nPosition [B], Size [B], Millis [ms]\n\n")); err != nil {
-				return fmt.Errorf("Error writing header to stats file : %s", err)
-			}
-		}
-		defer stats.Close()
+	logs, err := OpenStepLogs(statsFile, "")
+	if err != nil {
+		return err
 	}
+	defer logs.Close()
 
 	// Move to position
 	if progress.Pos == 0 {
-		progress.Pos = CHUNKSIZE // First chunk contains magic, skip it
-	}
-	if err := disk.Seek(progress.Pos); err != nil {
-		return err
+		progress.Pos = progress.RangeStart() // First chunk contains magic, skip it
 	}
+	progress.Pos = progress.NextSample(progress.Pos)
+	end := progress.RangeEnd()
 
 	// Background chunk production instance
 	var cf ChunkFactory
-	cf.StartProduce(CHUNKSIZE)
+	cf.StartProduce(int(chunkSize), progress.ChunkParams(), progress.Pos, progress.NextSample)
 	defer cf.Stop()
 
-	fmt.Printf("\033[s") // save cursor position
-	for progress.Pos < progress.Size {
+	// Chunks in flight. Their writes must be done, before the chunk factory stops
+	queue := NewIOQueue(depth, int(chunkSize), progress.SampledChunks(progress.Pos, end), qstats)
+	defer queue.Drain()
+	next := progress.Pos // Position of the next chunk to submit
+
+	startProgress()
+	for progress.Pos < end {
 		if !running {
 			return fmt.Errorf("interrupted")
 		}
-		// Determine size of current chunk - at the end of the disk this might not be the full size anymore
-		size := int64(CHUNKSIZE)
-		if progress.Pos+CHUNKSIZE > progress.Size {
-			size = progress.Size - progress.Pos
-			chunk = chunk[:size]
-		}
+		// Keep the queue filled
+		for next < end && !queue.Full() {
+			// Determine size of current chunk - at the ends of the range this might not be the full size
+			size := progress.ChunkSizeAt(next)
 
-		// Create chunk
-		if err := cf.Read(chunk); err != nil {
-			return fmt.Errorf("ChunkFactory read error: %s", err)
-		}
-		// Write chunk to file with runtime
-		runtime := time.Now().UnixNano()
-		if n, err := disk.Write(chunk); err != nil {
-			return err
-		} else {
-			size = int64(n)
+			// Create chunk
+			c := queue.Next(next, size)
+			if err := cf.Read(c.Buf); err != nil {
+				return fmt.Errorf("ChunkFactory read error: %s", err)
+			}
+			// Write chunk to file with runtime
+			queue.Submit(c, func(c *ChunkIO) {
+				start := time.Now()
+				if c.N, c.Err = disk.WriteAt(c.Buf, c.Pos); c.Err == nil {
+					c.Err = disk.Sync()
+				}
+				c.Runtime = time.Since(start)
+			})
+			next = progress.NextSample(next + size)
 		}
-		if err := disk.Sync(); err != nil {
-			return err
+
+		// Chunks complete in order, so the oldest one is always the chunk at the current position
+		c := queue.Wait()
+		if c.Err != nil {
+			return c.Err
 		}
-		runtime = time.Now().UnixNano() - runtime
-		millis := runtime / 1e6
+		size := int64(c.N)
+		millis := c.Runtime.Milliseconds()
 
 		// Write performance stats
-		if statsFile != "" {
-			line := fmt.Sprintf("%d,%d,%d\n", progress.Pos, size, millis)
-			if _, err := stats.Write([]byte(line)); err != nil {
-				return fmt.Errorf("Error writing to stats file: %s", err)
-			}
+		if err := logs.WriteStats(progress.Pos, size, millis); err != nil {
+			return err
 		}
 
 		// Update progress
-		progress.Pos += size
+		progress.Pos = progress.NextSample(progress.Pos + size)
 		if err := progress.WriteIfOpen(); err != nil {
 			return fmt.Errorf("Error writing progress file: %s", err)
 		}
 
 		// Compute throughput and print update
-		throughput := (float32(size) / float32(millis)) * 1e3
+		throughput := float32(float64(size) / c.Interval.Seconds())
 
-		fmt.Printf("\033[u") // restore cursor position
-		fmt.Printf("\033[K") // erase rest of line
-		percent := 100.0 * (float32(progress.Pos) / float32(disk.Size()))
-		fmt.Printf("Writing chunks: %.2f %% done @ %s/s", percent, gibistr(smooth(throughput, 0.75)))
+		printProgress("Writing", progress.Percent(), throughput)
 	}
 
-	fmt.Printf("\033[u") // restore cursor position
-	fmt.Printf("\033[K") // erase rest of line
+	clearProgress()
 	fmt.Println("Write test successful")
 
 	return nil
 }
 
-/* Do the read check*/
-func ReadCheck(disk *Disk, progress *Progress) error {
-	chunk := make([]byte, CHUNKSIZE)
+// Print the differing bytes of a chunk at the given disk position
+func printChunkDiff(pos int64, chunk []byte, expected []byte, lbaSize int) {
+	const maxLines = 16 // Limit output for heavily corrupted chunks
+	diff := DiffChunk(chunk, expected)
+	fmt.Fprintf(os.Stderr, "%d bytes differ from the expected chunk\n", len(diff))
+	for i, j := range diff {
+		if i >= maxLines {
+			fmt.Fprintf(os.Stderr, "  ... (%d more)\n", len(diff)-maxLines)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "  disk position %d (LBA %d): expected 0x%02x, got 0x%02x\n", pos+int64(j), (pos+int64(j))/int64(lbaSize), expected[j], chunk[j])
+	}
+}
+
+/* Verify a chunk read from the given disk position.
+ * The expected chunk is only used for reproducible runs, the sector sizes of the disk for the error analysis.
+ * Returns the error record of a failed chunk or nil, if the chunk is fine
+ */
+func verifyReadChunk(pos int64, chunk []byte, expected []byte, params ChunkParams, disk *Disk) *ChunkError {
+	var cerr *ChunkError
+	valid := params.Pattern == nil && VerifyChunk(chunk) // Fixed patterns can only be compared
+	header, hasHeader := ParseChunkHeader(chunk)
+	if hasHeader && valid && header.RunID != params.RunID {
+		cerr = NewChunkError(pos, len(chunk), params.ChunkSize, disk.LogicalSectorSize(), "foreign-run")
+		cerr.Foreign = header.RunID.String()
+	} else if hasHeader && valid && header.Offset != pos {
+		// A valid header at the wrong place is a misdirected (or aliased) write
+		cerr = NewChunkError(pos, len(chunk), params.ChunkSize, disk.LogicalSectorSize(), "misdirected")
+		cerr.BelongsTo = header.Offset
+	} else if params.Reproducible() && !bufCompare(chunk, expected) {
+		cerr = NewChunkError(pos, len(chunk), params.ChunkSize, disk.LogicalSectorSize(), "mismatch")
+		cerr.Analyse(chunk, expected, disk.PhysicalSectorSize())
+	} else if params.Pattern == nil && !valid {
+		cerr = NewChunkError(pos, len(chunk), params.ChunkSize, disk.LogicalSectorSize(), "checksum")
+		// Without the expected chunk, the sector checksums narrow down the bad bytes
+		for _, i := range FailedSectors(chunk, params.SectorSize) {
+			start, end := pos+int64(i*params.SectorSize), pos+int64((i+1)*params.SectorSize)
+			if end > pos+int64(len(chunk)) {
+				end = pos + int64(len(chunk))
+			}
+			cerr.Ranges = insertRange(cerr.Ranges, [2]int64{start, end})
+		}
+	}
+	return cerr
+}
+
+// Print the details of a failed chunk
+func printChunkError(cerr *ChunkError, chunk []byte, expected []byte, params ChunkParams) {
+	fmt.Println()
+	fmt.Fprintf(os.Stderr, "Chunk %d verification error (disk position %d, LBA %d)\n", cerr.Chunk, cerr.Pos, cerr.LBA)
+	switch cerr.Reason {
+	case "foreign-run":
+		fmt.Fprintf(os.Stderr, "The chunk belongs to a different run (run ID %s)\n", cerr.Foreign)
+	case "misdirected":
+		fmt.Fprintf(os.Stderr, "Misdirected write: The chunk belongs to disk position %d (chunk %d)\n", cerr.BelongsTo, cerr.BelongsTo/int64(params.ChunkSize))
+	case "mismatch":
+		printChunkDiff(cerr.Pos, chunk, expected, cerr.LBASize)
+		cerr.PrintSummary()
+		printFailedSectors(cerr.Pos, chunk, params.SectorSize, cerr.LBASize)
+	default:
+		printFailedSectors(cerr.Pos, chunk, params.SectorSize, cerr.LBASize)
+	}
+}
+
+/* Re-read a failed chunk according to the retry policy and verify it again.
+ * Without expected chunk (read-only scans) the chunk only needs to read fine.
+ * Returns the number of retries and if the chunk finally read fine
+ */
+func retryChunk(disk *Disk, pos int64, chunk []byte, expected []byte, params ChunkParams, retry *RetryPolicy) (int, bool) {
+	for i := 1; i <= retry.Retries; i++ {
+		if retry.DropCache {
+			if err := disk.DropCache(pos, int64(len(chunk))); err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot drop the page cache (%s), retrying without\n", err)
+				retry.DropCache = false
+			}
+		}
+		var n int
+		var err error
+		if retry.Direct {
+			n, err = disk.ReadDirect(chunk, pos)
+		} else {
+			n, err = disk.ReadAt(chunk, pos)
+		}
+		if err != nil || n != len(chunk) {
+			continue
+		}
+		if expected == nil || verifyReadChunk(pos, chunk, expected, params, disk) == nil {
+			return i, true
+		}
+	}
+	return retry.Retries, false
+}
+
+// Print the sectors of a chunk at the given disk position, whose sector checksum failed
+func printFailedSectors(pos int64, chunk []byte, sectorSize int, lbaSize int) {
+	failed := FailedSectors(chunk, sectorSize)
+	if failed == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%d sectors with %d bytes failed their checksum\n", len(failed), sectorSize)
+	for _, i := range failed {
+		sectorPos := pos + int64(i*sectorSize)
+		fmt.Fprintf(os.Stderr, "  disk position %d, LBA %d\n", sectorPos, sectorPos/int64(lbaSize))
+	}
+}
+
+/* Do the read check with the given queue depth. The throughput is accounted to the given queue stats.
+ * Failed chunks are re-read according to the retry policy. Chunks which read fine after retries are recovered, all
+ * others are bad. Both are recorded in the given errors file, if present, and in the progress. Depending on the error
+ * budget the check continues after bad chunks, but it fails in the end if any chunk was bad
+ */
+func ReadCheck(disk *Disk, progress *Progress, errorsFile string, budget ErrorBudget, retry RetryPolicy, depth int, qstats *QueueStats) error {
+	chunkSize := int64(progress.ChunkSize)
+
+	logs, err := OpenStepLogs("", errorsFile)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+	if retry.Direct {
+		if err := disk.OpenDirect(); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot use direct I/O (%s), retrying with buffered reads\n", err)
+			retry.Direct = false
+		}
+	}
 
 	// Move to position
 	if progress.Pos == 0 {
-		progress.Pos = CHUNKSIZE // First chunk contains magic, skip it
+		progress.Pos = progress.RangeStart() // First chunk contains magic, skip it
 	}
-	if err := disk.Seek(progress.Pos); err != nil {
-		return err
+	progress.Pos = progress.NextSample(progress.Pos)
+	end := progress.RangeEnd()
+
+	// Rebuild the expected chunks in the background for the byte-exact comparison.
+	// Runs without seed (older progress files) can only be verified by their checksum
+	var cf ChunkFactory
+	params := progress.ChunkParams()
+	if params.Reproducible() {
+		cf.StartProduce(int(chunkSize), progress.ChunkParams(), progress.Pos, progress.NextSample)
+		defer cf.Stop()
 	}
 
-	// Read chunks one by one and verify them
-	fmt.Printf("\033[s") // save cursor position
-	for progress.Pos < progress.Size {
+	// Chunks in flight, they are read and verified in parallel
+	queue := NewIOQueue(depth, int(chunkSize), progress.SampledChunks(progress.Pos, end), qstats)
+	defer queue.Drain()
+	next := progress.Pos // Position of the next chunk to submit
+
+	// Complete the chunks one by one in order and handle the failed ones
+	startProgress()
+	for progress.Pos < end {
 		if !running {
 			return fmt.Errorf("interrupted")
 		}
-		// Read and verify chunk
-		runtime := time.Now().UnixNano()
-		n, err := disk.Read(chunk)
-		runtime = time.Now().UnixNano() - runtime
-		if err != nil {
-			return err
-		} else if n < len(chunk) { // at the end of the disk, the chunk might be smaller
-			chunk = chunk[:n]
+		// Keep the queue filled
+		for next < end && !queue.Full() {
+			size := progress.ChunkSizeAt(next) // at the ends of the range, the chunk might be smaller
+			// Without direct I/O the chunk might still be in the page cache from the write check
+			disk.dropCacheBeforeRead(next, size)
+			c := queue.Next(next, size)
+			if params.Reproducible() {
+				if err := cf.Read(c.Expected); err != nil {
+					return fmt.Errorf("ChunkFactory read error: %s", err)
+				}
+			}
+			// Read and verify chunk
+			queue.Submit(c, func(c *ChunkIO) {
+				start := time.Now()
+				c.N, c.Err = disk.ReadAt(c.Buf, c.Pos)
+				c.Runtime = time.Since(start)
+				if c.Err == nil && c.N == len(c.Buf) {
+					c.Cerr = verifyReadChunk(c.Pos, c.Buf, c.Expected, params, disk)
+				}
+			})
+			next = progress.NextSample(next + size)
 		}
-		if !VerifyChunk(chunk) {
+
+		c := queue.Wait()
+		chunk, expected := c.Buf, c.Expected
+		size := int64(len(chunk))
+		n, readErr := c.N, c.Err
+		var cerr *ChunkError
+		if readErr != nil || int64(n) != size {
+			if readErr == nil {
+				readErr = fmt.Errorf("short read at %d", progress.Pos)
+			}
 			fmt.Println()
-			fmt.Fprintf(os.Stderr, "Chunk %d verification error (disk position %d)\n", progress.Pos/CHUNKSIZE, progress.Pos)
-			return err
+			fmt.Fprintf(os.Stderr, "Chunk %d read error (disk position %d, LBA %d): %v\n", progress.Pos/chunkSize, progress.Pos, progress.Pos/int64(disk.LogicalSectorSize()), readErr)
+			cerr = NewChunkError(progress.Pos, int(size), int(chunkSize), disk.LogicalSectorSize(), "read-error")
+		} else if cerr = c.Cerr; cerr != nil {
+			printChunkError(cerr, chunk, expected, params)
 		}
+		if cerr != nil {
+			cerr.Retries, cerr.Recovered = retryChunk(disk, progress.Pos, chunk, expected, params, &retry)
+			logs.WriteError(cerr)
+		}
+		if cerr != nil && cerr.Recovered {
+			fmt.Fprintf(os.Stderr, "Chunk %d recovered after %d retries\n", cerr.Chunk, cerr.Retries)
+			progress.Recovered = insertPosition(progress.Recovered, progress.Pos)
+		} else if cerr != nil {
+			if cerr.Retries > 0 {
+				fmt.Fprintf(os.Stderr, "Chunk %d still bad after %d retries\n", cerr.Chunk, cerr.Retries)
+			}
+			if readErr != nil && !budget.Continue {
+				return readErr
+			}
+			progress.AddBad(cerr)
+			checked := progress.SampledChunks(progress.RangeStart(), progress.Pos+size)
+			if budget.Exceeded(len(progress.Bad), checked) {
+				progress.WriteIfOpen()
+				if !budget.Continue {
+					return fmt.Errorf("chunk verification failed")
+				}
+				return fmt.Errorf("error budget exceeded (%d bad chunks out of %d)", len(progress.Bad), checked)
+			}
+		}
+		n = int(size)
 
 		// Update progress
-		progress.Pos += int64(n)
+		progress.Pos = progress.NextSample(progress.Pos + int64(n))
 		if err := progress.WriteIfOpen(); err != nil {
 			return fmt.Errorf("Error writing progress file: %s", err)
 		}
 
 		// Print stats
-		millis := runtime / 1e6
-		throughput := (float32(n) / float32(millis)) * 1e3
-		fmt.Printf("\033[u") // restore cursor position
-		fmt.Printf("\033[K") // erase rest of line
-		percent := 100.0 * (float32(progress.Pos) / float32(disk.Size()))
-		fmt.Printf("Reading chunks: %.2f %% done @ %s/s", percent, gibistr(smooth(throughput, 0.75)))
+		throughput := float32(float64(n) / c.Interval.Seconds())
+		printProgress("Reading", progress.Percent(), throughput)
 	}
 
-	fmt.Printf("\033[u") // restore cursor position
-	fmt.Printf("\033[K") // erase rest of line
+	clearProgress()
+	if len(progress.Bad) > 0 {
+		fmt.Println()
+		return fmt.Errorf("%d bad chunks", len(progress.Bad))
+	}
 	fmt.Println("Read test successful")
 
 	return nil
 }
 
 func printUsage() {
-	fmt.Printf("Usage: %s DISK [PROGRESS] [SPEEDLOG]\n", os.Args[0])
+	fmt.Printf("Usage: %s [OPTIONS] DISK [PROGRESS] [SPEEDLOG]\n", os.Args[0])
+	fmt.Printf("       %s inspect DISK\n", os.Args[0])
 	fmt.Println("    DISK:         Disk file under test")
 	fmt.Println("    PROGRESS:     Progress file, required for job continuation")
 	fmt.Println("    SPEEDLOG:     Performance metrics log")
+	fmt.Println("    inspect:      Print the run header of a disk, which a previous run touched")
+	fmt.Println("")
+	fmt.Println("OPTIONS")
+	fmt.Println("    --seed SEED   Use the given (non-zero) seed for the chunk pattern, e.g. to replay a run")
+	fmt.Println("    --errors FILE Record failed chunks as JSON lines to FILE (default: SPEEDLOG.errors)")
+	fmt.Println("    --hash HASH   Chunk digest algorithm: crc32c (default), fnv64 or sha256")
+	fmt.Println("    --chunk-size SIZE")
+	fmt.Println("                  Chunk size, e.g. 1M or 64M. Must be a multiple of the physical sector size and fit into the tested range (default 4M)")
+	fmt.Println("    --continue    Continue the read check after bad chunks and report all of them in the end")
+	fmt.Println("    --max-errors N")
+	fmt.Println("                  With --continue, abort after N bad chunks")
+	fmt.Println("    --max-error-rate PERCENT")
+	fmt.Println("                  With --continue, abort when more than PERCENT of the checked chunks are bad")
+	fmt.Println("    --retries N   Re-read a failed chunk up to N times. Chunks which read fine after a retry are reported")
+	fmt.Println("                  as recovered instead of bad")
+	fmt.Println("    --retry-drop-cache")
+	fmt.Println("                  Drop the chunk from the page cache before every re-read (implies --retries 1)")
+	fmt.Println("    --retry-direct")
+	fmt.Println("                  Re-read with direct I/O, bypassing the page cache (implies --retries 1)")
+	fmt.Println("    --yes-i-know  Don't ask for confirmation before destroying all data on a block device")
+	fmt.Println("    --ignore-in-use")
+	fmt.Println("                  Test the disk even if it or one of its partitions is mounted, swap or held by another device")
+	fmt.Println("    --sysroot DIR Read sys and proc below DIR instead of / (for testing against fixture trees)")
+	fmt.Println("    --buffered    Use buffered I/O and drop the page cache before reads instead of direct I/O")
+	fmt.Println("    --wipe MODE   Wipe the disk after a successful test: 'zero' writes and verifies zeros, 'discard'")
+	fmt.Println("                  discards the whole disk and 'clear' only clears the run header")
+	fmt.Println("    --start POS   Only test the disk from POS on, in bytes with optional unit (e.g. 500G) or as LBA (e.g. 2048s)")
+	fmt.Println("    --end POS     Only test the disk up to POS (exclusive). The range is extended to whole chunks")
+	fmt.Println("    --sample PERCENT")
+	fmt.Println("                  Only write and verify a random sample of PERCENT of the chunks, spread across the disk")
+	fmt.Println("    --read-only   Non-destructive surface scan: Only read the disk, time every chunk and record read errors")
+	fmt.Println("                  and slow regions. Never writes to the disk")
+	fmt.Println("    --non-destructive")
+	fmt.Println("                  Read-write test preserving the data: Save every chunk to a journal, write and verify the")
+	fmt.Println("                  test chunks and restore the original data (like badblocks -n)")
+	fmt.Println("    --slow MILLIS Chunks taking longer than MILLIS ms to read are slow (default: 5 times the average)")
+	fmt.Println("    --queue-depth N")
+	fmt.Printf("                  Keep up to N chunks (max. %d) in flight in the write and read checks (default: 1). Reports\n", QUEUE_MAX)
+	fmt.Println("                  the throughput side by side with queue depth 1")
+	fmt.Println("    --badblocks FILE")
+	fmt.Println("                  Export the bad regions as block list for mke2fs -l and e2fsck -l (badblocks -o format)")
+	fmt.Println("    --block-size SIZE")
+	fmt.Println("                  Block size of the bad blocks list (default: 4096)")
+	fmt.Println("    --probe       Quick fake-capacity probe: Write and verify tagged blocks across the disk only")
+	fmt.Println("    --patterns LIST")
+	fmt.Println("                  Comma separated list of write/read passes. Every pass is either 'random', a hex")
+	fmt.Println("                  pattern (e.g. 0xaa or 0xdeadbeef) or 'classic' for the 0xaa,0x55,0xff,0x00 passes")
+	fmt.Println("    --sector-size SIZE")
+	fmt.Println("                  Store a checksum for every SIZE bytes of a chunk to pinpoint failing sectors (e.g. 4096)")
+}
+
+// Get the value of the option at args[*i] and advance i
+func optionValue(args []string, i *int) (string, error) {
+	if *i+1 >= len(args) {
+		return "", fmt.Errorf("missing value for %s", args[*i])
+	}
+	*i = *i + 1
+	return args[*i], nil
 }
 
 func parseArgs(args []string, cf *conf) error {
@@ -346,25 +684,318 @@ func parseArgs(args []string, cf *conf) error {
 		os.Stdout.Sync() // Ensure usage is flushed to stdout before returning with an error
 		return fmt.Errorf("Missing arguments")
 	}
-	if len(args) >= 2 {
-		cf.disk = args[1]
-		if cf.disk == "-h" || cf.disk == "--help" {
+	positional := make([]string, 0)
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' {
+			positional = append(positional, arg)
+			continue
+		}
+		switch arg {
+		case "-h", "--help":
 			printUsage()
 			os.Exit(0)
+		case "--seed":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.seed, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return fmt.Errorf("invalid seed: %s", err)
+			} else if cf.seed == 0 {
+				return fmt.Errorf("seed must not be 0")
+			}
+		case "--errors":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			cf.errors = value
+		case "--hash":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.hash, err = ParseHashType(value); err != nil {
+				return err
+			}
+		case "--chunk-size":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			size, err := parseBytes(value)
+			if err != nil {
+				return fmt.Errorf("invalid chunk size: %s", err)
+			}
+			cf.chunkSize = int(size)
+		case "--continue":
+			cf.budget.Continue = true
+		case "--max-errors":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.budget.MaxErrors, err = strconv.Atoi(value); err != nil {
+				return fmt.Errorf("invalid number of errors: %s", err)
+			}
+		case "--max-error-rate":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.budget.MaxRate, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64); err != nil {
+				return fmt.Errorf("invalid error rate: %s", err)
+			}
+		case "--retries":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.retry.Retries, err = strconv.Atoi(value); err != nil {
+				return fmt.Errorf("invalid number of retries: %s", err)
+			} else if cf.retry.Retries < 0 {
+				return fmt.Errorf("invalid number of retries %d", cf.retry.Retries)
+			}
+		case "--retry-drop-cache":
+			cf.retry.DropCache = true
+		case "--retry-direct":
+			cf.retry.Direct = true
+		case "--yes-i-know":
+			cf.yes = true
+		case "--ignore-in-use":
+			cf.inUse = true
+		case "--sysroot":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			SYSFS_ROOT = filepath.Join(value, "sys")
+			PROC_ROOT = filepath.Join(value, "proc")
+		case "--buffered":
+			cf.direct = false
+		case "--wipe":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.wipe, err = ParseWipeMode(value); err != nil {
+				return err
+			}
+		case "--start":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.start, err = parseOffset(value); err != nil {
+				return fmt.Errorf("invalid start: %s", err)
+			}
+		case "--end":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.end, err = parseOffset(value); err != nil {
+				return fmt.Errorf("invalid end: %s", err)
+			}
+		case "--sample":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.sample, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64); err != nil {
+				return fmt.Errorf("invalid sample percentage: %s", err)
+			} else if cf.sample <= 0 {
+				return fmt.Errorf("invalid sample percentage %g", cf.sample)
+			}
+		case "--read-only":
+			cf.readOnly = true
+		case "--non-destructive":
+			cf.preserve = true
+		case "--slow":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			millis, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid slow read time: %s", err)
+			} else if millis <= 0 {
+				return fmt.Errorf("invalid slow read time %d", millis)
+			}
+			cf.slow = time.Duration(millis) * time.Millisecond
+		case "--queue-depth":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.depth, err = strconv.Atoi(value); err != nil {
+				return fmt.Errorf("invalid queue depth: %s", err)
+			}
+		case "--badblocks":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			cf.badblocks = value
+		case "--block-size":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.blockSize, err = parseBytes(value); err != nil {
+				return fmt.Errorf("invalid block size: %s", err)
+			} else if cf.blockSize <= 0 {
+				return fmt.Errorf("invalid block size %d", cf.blockSize)
+			}
+		case "--probe":
+			cf.probe = true
+		case "--patterns":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.passes, err = ParsePasses(value); err != nil {
+				return err
+			}
+		case "--sector-size":
+			value, err := optionValue(args, &i)
+			if err != nil {
+				return err
+			}
+			if cf.sectors, err = strconv.Atoi(value); err != nil {
+				return fmt.Errorf("invalid sector size: %s", err)
+			}
+		default:
+			return fmt.Errorf("unknown option: %s", arg)
 		}
 	}
-	if len(args) >= 3 {
-		cf.progress = args[2]
+	if len(positional) >= 1 {
+		cf.disk = positional[0]
+	}
+	if len(positional) >= 2 {
+		cf.progress = positional[1]
 	}
-	if len(args) >= 4 {
-		cf.stats = args[3]
+	if len(positional) >= 3 {
+		cf.stats = positional[2]
 	}
-	if len(args) > 4 {
+	if len(positional) > 3 {
 		return fmt.Errorf("too many arguments")
 	}
+	// Cache dropping and direct I/O are only useful with retries
+	if (cf.retry.DropCache || cf.retry.Direct) && cf.retry.Retries == 0 {
+		cf.retry.Retries = 1
+	}
+	// The errors file goes next to the performance log by default
+	if cf.errors == "" && cf.stats != "" {
+		cf.errors = cf.stats + ".errors"
+	}
 	return nil
 }
 
+// Export the bad blocks list, if configured
+func exportBadBlocks(progress *Progress) {
+	if cf.badblocks == "" {
+		return
+	}
+	if err := ExportBadBlocks(cf.badblocks, progress, cf.blockSize); err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting bad blocks to %s: %s\n", cf.badblocks, err)
+		return
+	}
+	fmt.Printf("Bad blocks list (%d byte blocks) written to %s\n", cf.blockSize, cf.badblocks)
+}
+
+// Ask the user to confirm the destruction of all data on the disk. Regular files don't need a confirmation
+func confirmDisk(disk *Disk) {
+	if cf.yes {
+		return
+	}
+	id, block, err := disk.Identity()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error identifying disk: %s\n", err)
+		os.Exit(1)
+	}
+	if !block {
+		return
+	}
+	if err := ConfirmDestruction(id, os.Stdin); err != nil {
+		fmt.Fprintf(os.Stderr, "Aborted: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// Print the run header and the first chunk of a disk, which a previous run touched. Returns the exit code
+func runInspect(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s inspect DISK\n", os.Args[0])
+		return 1
+	}
+	disk := CreateDisk(args[0])
+	if err := disk.OpenReadOnly(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening disk: %s\n", err)
+		return 1
+	}
+	defer disk.Close()
+	header, err := disk.ReadHeader()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err)
+		return 1
+	}
+	fmt.Printf("Disk:       %s\n", args[0])
+	header.Print()
+	if header.Version == 0 || int64(header.ChunkSize) >= disk.Size() {
+		return 0
+	}
+
+	// The first chunk behind the header tells, if the write check of the run has started
+	buf := alignedBuffer(header.ChunkSize, DIRECT_ALIGNMENT)
+	if _, err := disk.ReadAt(buf, int64(header.ChunkSize)); err != nil && err != io.EOF {
+		fmt.Fprintf(os.Stderr, "Read error: %s\n", err)
+		return 1
+	}
+	if chunk, ok := ParseChunkHeader(buf); !ok || !VerifyChunk(buf) {
+		fmt.Println("Chunk 1:    no valid chunk (not written yet or a fixed pattern pass)")
+	} else if chunk.RunID != header.RunID {
+		fmt.Printf("Chunk 1:    belongs to run %s\n", chunk.RunID)
+	} else {
+		fmt.Printf("Chunk 1:    valid, layout version %d\n", chunk.Version)
+	}
+	return 0
+}
+
+// Run the fake-capacity probe and return the exit code
+func runProbe(disk *Disk) int {
+	var progress Progress
+	progress.InitRun(&cf)
+	// Probe blocks are as small as possible but must hold a chunk header
+	progress.ChunkSize = 4096
+	if disk.PhysicalSectorSize() > progress.ChunkSize {
+		progress.ChunkSize = disk.PhysicalSectorSize()
+	}
+	if disk.Size() < int64(progress.ChunkSize) {
+		fmt.Fprintf(os.Stderr, "Invalid disk size %d\n", disk.Size())
+		return 1
+	}
+	go terminationSignalHandler()
+	capacity, limit, err := Probe(disk, progress.ChunkParams())
+	if err != nil {
+		if err.Error() == "interrupted" {
+			done <- true
+			fmt.Fprintf(os.Stderr, "Cancelled\n")
+		} else {
+			fmt.Fprintf(os.Stderr, "Probe failed: %s\n", err)
+		}
+		return 13
+	}
+	if limit < disk.Size() {
+		fmt.Printf("FAKE CAPACITY: The disk reports %s (%d bytes), but only %s (%d bytes) are usable\n", gibistr(float32(disk.Size())), disk.Size(), gibistr(float32(capacity)), capacity)
+		fmt.Printf("The real capacity is below %s (%d bytes), where the first block failed\n", gibistr(float32(limit)), limit)
+		return 13
+	}
+	fmt.Printf("Probe successful: All %s (%d bytes) are usable\n", gibistr(float32(disk.Size())), disk.Size())
+	return 0
+}
+
 func terminationSignalHandler() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -392,8 +1023,33 @@ func main() {
 	cf.disk = ""
 	cf.progress = ""
 	cf.stats = ""
+	cf.errors = ""
+	cf.seed = 0
+	cf.hash = HASH_NONE
+	cf.sectors = 0
+	cf.passes = nil
+	cf.chunkSize = 0
+	cf.probe = false
+	cf.budget = ErrorBudget{}
+	cf.retry = RetryPolicy{}
+	cf.direct = true
+	cf.inUse = false
+	cf.yes = false
+	cf.wipe = ""
+	cf.start = Offset{}
+	cf.end = Offset{}
+	cf.sample = 0
+	cf.readOnly = false
+	cf.preserve = false
+	cf.slow = 0
+	cf.depth = 1
+	cf.badblocks = ""
+	cf.blockSize = 4096
 	cf.verbose = false
 
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		os.Exit(runInspect(os.Args[2:]))
+	}
 	if err := parseArgs(os.Args, &cf); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
@@ -407,11 +1063,51 @@ func main() {
 
 	// Prepare disk
 	disk := CreateDisk(cf.disk)
-	if err := disk.Open(); err != nil {
+	open := disk.Open
+	if cf.readOnly {
+		open = disk.OpenReadOnly
+	}
+	if err := open(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error opening disk: %s\n", err)
 		os.Exit(1)
 	}
 	defer disk.Close()
+	for _, warning := range disk.GeometryWarnings() {
+		fmt.Fprintf(os.Stderr, "Warning: Disk geometry mismatch: %s\n", warning)
+	}
+	// Never overwrite a disk, which is in use. Reading it is fine
+	if uses, err := disk.InUse(); cf.readOnly {
+		if len(uses) > 0 {
+			fmt.Printf("Note: %s is in use, scanning it read-only\n", cf.disk)
+		}
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot check if the disk is in use: %s\n", err)
+		if !cf.inUse {
+			os.Exit(1)
+		}
+	} else if len(uses) > 0 {
+		fmt.Fprintf(os.Stderr, "%s is in use:\n", cf.disk)
+		for _, use := range uses {
+			fmt.Fprintf(os.Stderr, "  %s\n", use)
+		}
+		if !cf.inUse {
+			fmt.Fprintf(os.Stderr, "Refusing to overwrite it. Unmount, swapoff or deactivate it first, or use --ignore-in-use\n")
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: Testing it anyways, as requested\n")
+	}
+	// Bypass the page cache, so that we verify the disk and not the RAM
+	if cf.direct {
+		if err := disk.EnableDirect(); err != nil {
+			fmt.Fprintf(os.Stderr, "Direct I/O not available (%s), using buffered I/O with cache invalidation\n", err)
+		}
+	}
+
+	// The probe mode is a quick standalone test
+	if cf.probe {
+		confirmDisk(&disk)
+		os.Exit(runProbe(&disk))
+	}
 
 	// Load progress stats if present
 	if cf.progress != "" {
@@ -426,14 +1122,22 @@ func main() {
 			}
 			if progress.State == 0 {
 				fmt.Printf("Resume operation on disk\n")
+				if progress.Seed == 0 { // Nothing has been written yet, so also older progress files can use a seed
+					progress.InitRun(&cf)
+				}
+			} else if progress.State == 1 && progress.Preserve {
+				fmt.Printf("Resuming non-destructive test at %d (%.2f %% already done)\n", progress.Pos, progress.Percent())
 			} else if progress.State == 1 {
-				percent := 100.0 * (float32(progress.Pos) / float32(disk.Size()))
-				fmt.Printf("Resuming write test at %d (%.2f %% already done)\n", progress.Pos, percent)
+				fmt.Printf("Resuming write test of pass %d at %d (%.2f %% already done)\n", progress.Pass+1, progress.Pos, progress.Percent())
+			} else if progress.State == 2 && progress.ReadOnly {
+				fmt.Printf("Resuming read-only scan at %d (%.2f %% already done)\n", progress.Pos, progress.Percent())
 			} else if progress.State == 2 {
-				percent := 100.0 * (float32(progress.Pos) / float32(disk.Size()))
-				fmt.Printf("Resuming read test at %d (%.2f %% already done)\n", progress.Pos, percent)
+				fmt.Printf("Resuming read test of pass %d at %d (%.2f %% already done)\n", progress.Pass+1, progress.Pos, progress.Percent())
+			} else if progress.State == 4 {
+				fmt.Printf("Resuming wipe (%s) at %d (%.2f %% already done)\n", progress.Wipe, progress.Pos, progress.Percent())
 			} else if progress.State == 3 {
 				fmt.Println("Disk already completed. Nothing to be done")
+				exportBadBlocks(&progress)
 				os.Exit(0)
 			} else {
 				fmt.Fprintf(os.Stderr, "Invalid progress state %d\n", progress.State)
@@ -449,6 +1153,7 @@ func main() {
 			progress.Pos = 0
 			progress.State = 0
 			progress.Size = disk.Size()
+			progress.InitRun(&cf)
 			if err := progress.Write(); err != nil {
 				fmt.Fprintf(os.Stderr, "Error writing to new progress file %s: %s\n", cf.progress, err)
 				os.Exit(1)
@@ -459,6 +1164,76 @@ func main() {
 		progress.Size = disk.Size()
 		progress.Pos = 0
 		progress.State = 0
+		progress.InitRun(&cf)
+	}
+	if cf.seed != 0 && cf.seed != progress.Seed {
+		fmt.Fprintf(os.Stderr, "Error: seed mismatch\n")
+		fmt.Fprintf(os.Stderr, "The given seed is %d, but the progress file says it should be %d\n", cf.seed, progress.Seed)
+		os.Exit(1)
+	}
+	if cf.passes != nil && FormatPasses(cf.passes) != FormatPasses(progress.Passes) {
+		fmt.Fprintf(os.Stderr, "Error: pattern mismatch\n")
+		fmt.Fprintf(os.Stderr, "The given patterns are %s, but the progress file says they should be %s\n", FormatPasses(cf.passes), FormatPasses(progress.Passes))
+		os.Exit(1)
+	}
+	if cf.wipe != "" && cf.wipe != progress.Wipe {
+		// The wipe can be added to a running test. Changing it while wiping starts the wipe over in the new mode
+		if progress.State == 4 && progress.Pos >= progress.RangeEnd() {
+			fmt.Fprintf(os.Stderr, "Warning: The wipe (%s) is done except for clearing the run header, keeping it\n", progress.Wipe)
+		} else {
+			if progress.State == 4 {
+				fmt.Printf("Switching the wipe from %s to %s, the wipe starts over\n", progress.Wipe, cf.wipe)
+				progress.Pos = 0
+			}
+			progress.Wipe = cf.wipe
+		}
+	}
+	if given := (Progress{ReadOnly: cf.readOnly, Preserve: cf.preserve}); given.Mode() != progress.Mode() {
+		fmt.Fprintf(os.Stderr, "Error: mode mismatch\n")
+		fmt.Fprintf(os.Stderr, "The given mode is a %s, but the progress file belongs to a %s\n", given.Mode(), progress.Mode())
+		os.Exit(1)
+	}
+	if cf.sample != 0 && cf.sample != progress.Sample {
+		fmt.Fprintf(os.Stderr, "Error: sample mismatch\n")
+		fmt.Fprintf(os.Stderr, "The given sample is %g %%, but the progress file says it should be %g %%\n", cf.sample, progress.Sample)
+		os.Exit(1)
+	}
+	if cf.hash != HASH_NONE && cf.hash != progress.Hash {
+		fmt.Fprintf(os.Stderr, "Error: hash mismatch\n")
+		fmt.Fprintf(os.Stderr, "The given hash is %s, but the progress file says it should be %s\n", cf.hash, progress.Hash)
+		os.Exit(1)
+	}
+	if cf.chunkSize != 0 && cf.chunkSize != progress.ChunkSize {
+		fmt.Fprintf(os.Stderr, "Error: chunk size mismatch\n")
+		fmt.Fprintf(os.Stderr, "The given chunk size is %d, but the progress file says it should be %d\n", cf.chunkSize, progress.ChunkSize)
+		os.Exit(1)
+	}
+	if cf.sectors != 0 && cf.sectors != progress.Sectors {
+		fmt.Fprintf(os.Stderr, "Error: sector size mismatch\n")
+		fmt.Fprintf(os.Stderr, "The given sector size is %d, but the progress file says it should be %d\n", cf.sectors, progress.Sectors)
+		os.Exit(1)
+	}
+	if err := disk.CheckChunkSize(progress.ChunkSize); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid chunk size: %s\n", err)
+		os.Exit(1)
+	}
+	if progress.Sectors != 0 && progress.ChunkSize%progress.Sectors != 0 {
+		fmt.Fprintf(os.Stderr, "Invalid sector size: chunk size %d is not a multiple of the sector size %d\n", progress.ChunkSize, progress.Sectors)
+		os.Exit(1)
+	}
+	fmt.Printf("Chunk size: %s (sector size %d logical, %d physical)\n", gibistr(float32(progress.ChunkSize)), disk.LogicalSectorSize(), disk.PhysicalSectorSize())
+	if disk.IsDirect() {
+		fmt.Println("I/O mode: direct")
+	} else {
+		fmt.Println("I/O mode: buffered, dropping the page cache before reads")
+	}
+	if progress.ReadOnly {
+		fmt.Println("Mode: read-only surface scan, nothing is written to the disk")
+	} else if progress.Seed != 0 {
+		fmt.Printf("Run seed: %d (run ID %s, hash %s)\n", progress.Seed, progress.RunID, progress.Hash)
+	}
+	if progress.Preserve {
+		fmt.Println("Mode: non-destructive test, the original data is restored after testing every chunk")
 	}
 
 	if disk.Size() <= 0 {
@@ -466,28 +1241,71 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Check program internals before each run.
-	if err := CheckInternals(&disk); err != nil {
-		fmt.Fprintf(os.Stderr, "FATAL ERROR: Pre-flight checks failed. This is a program error, please report a bug!\n")
-		fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(42)
+	// Limit the run to the given range. New runs store it, resumed runs need to match
+	if cf.start.Value != 0 || cf.end.Value != 0 {
+		lbaSize := disk.LogicalSectorSize()
+		start, end, err := progress.CheckRange(cf.start.Bytes(lbaSize), cf.end.Bytes(lbaSize), lbaSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid range: %s\n", err)
+			os.Exit(1)
+		}
+		if progress.State == 0 {
+			progress.Start, progress.End = start, end
+		} else if start != progress.Start || end != progress.End {
+			given := Progress{Size: progress.Size, ChunkSize: progress.ChunkSize, Start: start, End: end}
+			fmt.Fprintf(os.Stderr, "Error: range mismatch\n")
+			fmt.Fprintf(os.Stderr, "The given range is %d-%d, but the progress file says it should be %d-%d\n", given.RangeStart(), given.RangeEnd(), progress.RangeStart(), progress.RangeEnd())
+			os.Exit(1)
+		}
 	}
+	// The first chunk of the range needs to fit into it. For a whole disk, the run header takes the first chunk
+	if progress.RangeStart()+int64(progress.ChunkSize) > progress.RangeEnd() {
+		fmt.Fprintf(os.Stderr, "Invalid chunk size: chunk size %d does not fit into the tested range %d-%d\n", progress.ChunkSize, progress.RangeStart(), progress.RangeEnd())
+		os.Exit(1)
+	}
+	if progress.IsRange() {
+		start, end := progress.RangeStart(), progress.RangeEnd()
+		lbaSize := int64(disk.LogicalSectorSize())
+		fmt.Printf("Range: %d-%d (%s, LBA %d-%d)\n", start, end, gibistr(float32(end-start)), start/lbaSize, end/lbaSize)
+	}
+	if progress.Sample > 0 && progress.Sample < 100 {
+		fmt.Printf("Sampling: %g %% of the chunks\n", progress.Sample)
+	}
+
+	// Bind the run to the physical disk, so that it cannot be resumed on another disk
+	id, _, err := disk.Identity()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error identifying disk: %s\n", err)
+		os.Exit(1)
+	}
+	if progress.State == 0 {
+		progress.BindDisk(id)
+	} else if err := progress.CheckDisk(id); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: disk identity mismatch\n")
+		fmt.Fprintf(os.Stderr, "%s (wrong disk?)\n", err)
+		os.Exit(1)
+	}
+
 	// Perform disk pre-flight checks, if we continue from a disk
 	if cf.progress != "" {
-		if progress.State < 0 || progress.State > 3 {
+		if progress.State < 0 || progress.State > 4 {
 			fmt.Fprintf(os.Stderr, "Invalid progress state %d\n", progress.State)
 			os.Exit(1)
 		}
+		if progress.Pass < 0 || progress.Pass >= progress.PassCount() {
+			fmt.Fprintf(os.Stderr, "Invalid progress pass %d\n", progress.Pass)
+			os.Exit(1)
+		}
 
 		if disk.Size() != progress.Size {
 			fmt.Fprintf(os.Stderr, "Error: disk size mismatch\n")
 			fmt.Fprintf(os.Stderr, "The disk reports %d bytes, but the progress file says it should be %d (wrong disk?)\n", disk.Size(), progress.Size)
 			os.Exit(1)
 		}
-		// Disk magic check only after preparation step
-		if progress.State > 0 {
-			if err := disk.CheckMagic(); err != nil {
-				fmt.Fprintf(os.Stderr, "Disk magic error: %s\n", err)
+		// Disk header check only after preparation step and until the wipe cleared the header
+		if progress.State > 0 && progress.Destructive() && !(progress.State == 4 && progress.Pos >= progress.RangeEnd()) {
+			if err := disk.CheckHeader(progress.RunID); err != nil {
+				fmt.Fprintf(os.Stderr, "Disk header error: %s\n", err)
 				os.Exit(1)
 			}
 		}
@@ -495,13 +1313,41 @@ func main() {
 		progress.Size = disk.Size()
 	}
 
+	// The internal checks already write to the disk, so new runs need to be confirmed first
+	if progress.State == 0 && progress.Destructive() {
+		confirmDisk(&disk)
+	}
+
+	// Check program internals before each run. Not while wiping or without destroying the data, as the checks write random data
+	if progress.State != 4 && progress.Destructive() {
+		if err := CheckInternals(&disk, progress.ChunkParams(), progress.RangeStart(), progress.ChunkSizeAt(progress.RangeStart())); err != nil {
+			fmt.Fprintf(os.Stderr, "FATAL ERROR: Pre-flight checks failed. This is a program error, please report a bug!\n")
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(42)
+		}
+	}
+
 	// Termination signal handler
 	go terminationSignalHandler()
 
+	// The read-only scan has no preparation and write step, the non-destructive test no preparation step
+	if progress.State == 0 && !progress.Destructive() {
+		progress.State = 1
+		if progress.ReadOnly {
+			progress.State = 2
+		}
+		progress.Pos = 0
+		if err := progress.WriteIfOpen(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing progress file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// Preparation step
 	if progress.State == 0 {
 		// Prepare disk
-		if err := disk.Prepare(); err != nil {
+		host, _ := os.Hostname()
+		if err := disk.Prepare(NewDiskHeader(&progress, host)); err != nil {
 			fmt.Fprintf(os.Stderr, "Disk preparation error: %s\n", err)
 			os.Exit(10)
 		}
@@ -513,18 +1359,31 @@ func main() {
 		}
 	}
 
-	// Write step
-	if progress.State == 1 {
-		if err := WriteCheck(&disk, &progress, cf.stats); err != nil {
+	// Non-destructive test of all passes at once, chunk by chunk
+	if progress.State == 1 && progress.Preserve {
+		var journal Journal
+		if err := journal.Open(cf.progress + ".journal"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening journal: %s\n", err)
+			os.Exit(1)
+		}
+		if err := NonDestructiveCheck(&disk, &progress, &journal, cf.stats, cf.errors, cf.budget); err != nil {
 			if err.Error() == "interrupted" {
 				done <- true
 				fmt.Fprintf(os.Stderr, "Cancelled\n")
 			} else {
-				fmt.Fprintf(os.Stderr, "Write check failed: %s\n", err)
+				fmt.Fprintf(os.Stderr, "Non-destructive test failed: %s\n", err)
+				PrintDamageReport(&progress, disk.LogicalSectorSize())
+				PrintSampleReport(&progress)
+				exportBadBlocks(&progress)
 			}
 			os.Exit(11)
 		}
-		progress.State = 2
+		if err := journal.Remove(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+		}
+		PrintDamageReport(&progress, disk.LogicalSectorSize())
+		PrintSampleReport(&progress)
+		progress.State = 3
 		progress.Pos = 0
 		if err := progress.WriteIfOpen(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error writing progress file: %s\n", err)
@@ -532,18 +1391,100 @@ func main() {
 		}
 	}
 
-	// Read step
-	if progress.State == 2 {
-		if err := ReadCheck(&disk, &progress); err != nil {
+	// Write and read step of every pass
+	var writeStats, readStats QueueStats
+	for progress.State == 1 || progress.State == 2 {
+		if progress.PassCount() > 1 {
+			fmt.Printf("Pass %d/%d (%s)\n", progress.Pass+1, progress.PassCount(), progress.CurrentPass())
+		}
+
+		// Write step
+		if progress.State == 1 {
+			if err := WriteCheck(&disk, &progress, cf.stats, cf.depth, &writeStats); err != nil {
+				if err.Error() == "interrupted" {
+					done <- true
+					fmt.Fprintf(os.Stderr, "Cancelled\n")
+				} else {
+					fmt.Fprintf(os.Stderr, "Write check failed: %s\n", err)
+				}
+				os.Exit(11)
+			}
+			progress.State = 2
+			progress.Pos = 0
+			progress.Bad = nil // The bad and recovered chunks of the read step of this pass
+			progress.BadRanges = nil
+			progress.Recovered = nil
+			// Make sure the read check doesn't get the data the kernel still has cached from the write check
+			method, err := disk.InvalidateCache()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Cannot invalidate the cache (%s), reads might not hit the disk\n", err)
+			} else {
+				fmt.Printf("Cache invalidated (%s)\n", method)
+			}
+			progress.Flush = method
+			if err := progress.WriteIfOpen(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing progress file: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		// Read step
+		if progress.State == 2 {
+			var err error
+			if progress.ReadOnly {
+				err = ScanCheck(&disk, &progress, cf.stats, cf.errors, cf.budget, cf.retry, cf.slow)
+			} else {
+				err = ReadCheck(&disk, &progress, cf.errors, cf.budget, cf.retry, cf.depth, &readStats)
+			}
+			if err != nil {
+				if err.Error() == "interrupted" {
+					done <- true
+					fmt.Fprintf(os.Stderr, "Cancelled\n")
+				} else {
+					fmt.Fprintf(os.Stderr, "Read check failed: %s\n", err)
+					PrintFlushReport(&progress)
+					PrintDamageReport(&progress, disk.LogicalSectorSize())
+					PrintSlowReport(&progress, disk.LogicalSectorSize())
+					PrintSampleReport(&progress)
+					exportBadBlocks(&progress)
+				}
+				os.Exit(12)
+			}
+			PrintFlushReport(&progress)
+			PrintDamageReport(&progress, disk.LogicalSectorSize()) // Recovered chunks of this pass
+			PrintSlowReport(&progress, disk.LogicalSectorSize())
+			PrintSampleReport(&progress)
+			PrintThroughputReport(writeStats, readStats)
+			// Continue with the next pass, if any
+			progress.Pos = 0
+			if progress.Pass+1 < progress.PassCount() {
+				progress.Pass++
+				progress.State = 1
+			} else if progress.Wipe != "" {
+				progress.State = 4
+			} else {
+				progress.State = 3
+			}
+			if err := progress.WriteIfOpen(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing progress file: %s\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// Wipe step
+	if progress.State == 4 {
+		if err := Wipe(&disk, &progress); err != nil {
 			if err.Error() == "interrupted" {
 				done <- true
 				fmt.Fprintf(os.Stderr, "Cancelled\n")
 			} else {
-				fmt.Fprintf(os.Stderr, "Read check failed: %s\n", err)
+				fmt.Fprintf(os.Stderr, "Wipe failed: %s\n", err)
 			}
-			os.Exit(12)
+			os.Exit(14)
 		}
 		progress.State = 3
+		progress.Pos = 0
 		if err := progress.WriteIfOpen(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error writing progress file: %s\n", err)
 			os.Exit(1)
@@ -551,6 +1492,7 @@ func main() {
 	}
 
 	// All good
+	exportBadBlocks(&progress)
 	done <- true
 	fmt.Println("Done")
 }
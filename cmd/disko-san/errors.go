@@ -0,0 +1,147 @@
+/* Error records of failed chunks for disko-san */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"os"
+	"time"
+)
+
+const MAX_ERROR_RANGES = 1024 // Limit the byte ranges per error record for heavily corrupted chunks
+
+// Error record of a failed chunk
+type ChunkError struct {
+	Time      int64      `json:"time"`                 // Unix timestamp of the failure
+	Chunk     int64      `json:"chunk"`                // Chunk index
+	Pos       int64      `json:"position"`             // Disk position of the chunk
+	Size      int        `json:"size"`                 // Chunk size
+	LBA       int64      `json:"lba"`                  // First LBA of the chunk
+	LBASize   int        `json:"lba_size"`             // Logical sector size of the LBAs
+	Reason    string     `json:"reason"`               // mismatch, misdirected, foreign-run, checksum or read-error
+	BelongsTo int64      `json:"belongs_to,omitempty"` // Disk position the chunk belongs to (misdirected)
+	BadBytes  int        `json:"bad_bytes"`            // Number of differing bytes
+	Ranges    [][2]int64 `json:"ranges,omitempty"`     // Disk positions [start,end) of consecutive bad bytes (failed sectors for checksum)
+	LBAs      [][2]int64 `json:"lbas,omitempty"`       // LBA ranges [first,last] of the bad bytes
+	Truncated bool       `json:"ranges_truncated,omitempty"`
+	Flipped   int        `json:"flipped_bits"` // Number of flipped bits
+	Flipped0  int        `json:"flipped_to_0"` // Bits read as 0 but expected 1
+	Flipped1  int        `json:"flipped_to_1"` // Bits read as 1 but expected 0
+	Stuck     string     `json:"stuck,omitempty"`
+	Sectors   []int64    `json:"sectors,omitempty"`     // Disk positions of the affected physical sectors
+	Pattern   string     `json:"pattern,omitempty"`     // clustered (single sector) or spread
+	Foreign   string     `json:"foreign_run,omitempty"` // Run ID of the chunk (foreign-run)
+	Retries   int        `json:"retries,omitempty"`     // Number of re-reads
+	Recovered bool       `json:"recovered,omitempty"`   // The chunk read fine after the retries
+}
+
+func NewChunkError(pos int64, size int, chunkSize int, lbaSize int, reason string) *ChunkError {
+	return &ChunkError{Time: time.Now().Unix(), Chunk: pos / int64(chunkSize), Pos: pos, Size: size, LBA: pos / int64(lbaSize), LBASize: lbaSize, Reason: reason}
+}
+
+/* Disk positions [start,end) of the bad bytes of the chunk.
+ * Records without byte ranges, e.g. read errors, or with truncated ranges cover the whole chunk
+ */
+func (e *ChunkError) BadRanges() [][2]int64 {
+	if len(e.Ranges) == 0 || e.Truncated {
+		return [][2]int64{{e.Pos, e.Pos + int64(e.Size)}}
+	}
+	return e.Ranges
+}
+
+/* Analyse the differing bytes between the read chunk and the expected chunk.
+ * The sector size is used to determine if the errors cluster in a single sector or are spread over the chunk
+ */
+func (e *ChunkError) Analyse(chunk []byte, expected []byte, sectorSize int) {
+	lastSector := int64(-1)
+	for _, i := range DiffChunk(chunk, expected) {
+		pos := e.Pos + int64(i)
+		e.BadBytes++
+		if n := len(e.Ranges); n > 0 && e.Ranges[n-1][1] == pos {
+			e.Ranges[n-1][1] = pos + 1
+		} else if n < MAX_ERROR_RANGES {
+			e.Ranges = append(e.Ranges, [2]int64{pos, pos + 1})
+		} else {
+			e.Truncated = true
+		}
+		diff := chunk[i] ^ expected[i]
+		e.Flipped += bits.OnesCount8(diff)
+		e.Flipped0 += bits.OnesCount8(diff & expected[i])
+		e.Flipped1 += bits.OnesCount8(diff & chunk[i])
+		if sector := pos - pos%int64(sectorSize); sector != lastSector {
+			e.Sectors = append(e.Sectors, sector)
+			lastSector = sector
+		}
+	}
+	if e.BadBytes == 0 {
+		return
+	}
+	lbaSize := int64(e.LBASize)
+	for _, r := range e.Ranges {
+		first, last := r[0]/lbaSize, (r[1]-1)/lbaSize
+		if n := len(e.LBAs); n > 0 && e.LBAs[n-1][1] >= first-1 {
+			e.LBAs[n-1][1] = last
+		} else {
+			e.LBAs = append(e.LBAs, [2]int64{first, last})
+		}
+	}
+	if e.Flipped1 == 0 {
+		e.Stuck = "stuck-at-0"
+	} else if e.Flipped0 == 0 {
+		e.Stuck = "stuck-at-1"
+	} else {
+		e.Stuck = "mixed"
+	}
+	if len(e.Sectors) == 1 {
+		e.Pattern = "clustered"
+	} else {
+		e.Pattern = "spread"
+	}
+}
+
+// Print a short summary of the bit flips
+func (e *ChunkError) PrintSummary() {
+	if e.BadBytes == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%d flipped bits (%d to 0, %d to 1, %s) in %d sectors (%s)\n", e.Flipped, e.Flipped0, e.Flipped1, e.Stuck, len(e.Sectors), e.Pattern)
+}
+
+// Machine-readable log of failed chunks, one JSON record per line
+type ErrorLog struct {
+	f *os.File
+}
+
+func (l *ErrorLog) Open(filename string) error {
+	var err error
+	l.f, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		l.f = nil
+	}
+	return err
+}
+
+func (l *ErrorLog) Close() error {
+	if l.f != nil {
+		err := l.f.Close()
+		l.f = nil
+		return err
+	}
+	return nil
+}
+
+// Append the given record, if the log is opened
+func (l *ErrorLog) Write(e *ChunkError) error {
+	if l.f == nil {
+		return nil
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
@@ -0,0 +1,16 @@
+//go:build linux && !386 && !arm && !mips && !mipsle && !s390x
+// +build linux,!386,!arm,!mips,!mipsle,!s390x
+
+package main
+
+import "syscall"
+
+const FADV_DONTNEED = 4
+
+// posix_fadvise for the given range of the file
+func fadvise(fd uintptr, offset int64, length int64, advice int) error {
+	if _, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, fd, uintptr(offset), uintptr(length), uintptr(advice), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
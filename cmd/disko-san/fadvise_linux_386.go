@@ -0,0 +1,13 @@
+package main
+
+import "syscall"
+
+const FADV_DONTNEED = 4
+
+// posix_fadvise for the given range of the file. The 64-bit offsets are split into two registers, low word first
+func fadvise(fd uintptr, offset int64, length int64, advice int) error {
+	if _, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64_64, fd, uintptr(offset), uintptr(offset>>32), uintptr(length), uintptr(length>>32), uintptr(advice)); errno != 0 {
+		return errno
+	}
+	return nil
+}
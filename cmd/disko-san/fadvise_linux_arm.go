@@ -0,0 +1,15 @@
+package main
+
+import "syscall"
+
+const FADV_DONTNEED = 4
+
+/* posix_fadvise for the given range of the file. On arm the advice comes second, so that the 64-bit offsets, split
+ * into two registers with the low word first, are aligned to register pairs
+ */
+func fadvise(fd uintptr, offset int64, length int64, advice int) error {
+	if _, _, errno := syscall.Syscall6(syscall.SYS_ARM_FADVISE64_64, fd, uintptr(advice), uintptr(offset), uintptr(offset>>32), uintptr(length), uintptr(length>>32)); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build linux && (mips || mipsle)
+// +build linux
+// +build mips mipsle
+
+package main
+
+import (
+	"runtime"
+	"syscall"
+)
+
+const FADV_DONTNEED = 4
+
+/* posix_fadvise for the given range of the file. The o32 ABI aligns the 64-bit offsets, split into two registers in
+ * the byte order of the machine, to register pairs, which needs a padding argument behind the file descriptor
+ */
+func fadvise(fd uintptr, offset int64, length int64, advice int) error {
+	off1, off2, len1, len2 := uintptr(offset), uintptr(offset>>32), uintptr(length), uintptr(length>>32)
+	if runtime.GOARCH == "mips" { // big endian, high word first
+		off1, off2, len1, len2 = off2, off1, len2, len1
+	}
+	if _, _, errno := syscall.Syscall9(syscall.SYS_FADVISE64, fd, 0, off1, off2, len1, len2, uintptr(advice), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
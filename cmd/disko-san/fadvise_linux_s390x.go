@@ -0,0 +1,13 @@
+package main
+
+import "syscall"
+
+const FADV_DONTNEED = 6 // s390x uses different advice values
+
+// posix_fadvise for the given range of the file
+func fadvise(fd uintptr, offset int64, length int64, advice int) error {
+	if _, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, fd, uintptr(offset), uintptr(length), uintptr(advice), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
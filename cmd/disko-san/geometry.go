@@ -0,0 +1,31 @@
+/* Disk geometry for disko-san */
+package main
+
+import "fmt"
+
+// Size and sector sizes of a disk, as reported by a single source
+type Geometry struct {
+	Source   string // Source of the values, e.g. "ioctl", "sysfs" or "seek"
+	Size     int64  // Disk size in bytes (0 = unknown)
+	Logical  int    // Logical sector size (0 = unknown)
+	Physical int    // Physical sector size (0 = unknown)
+}
+
+func (g Geometry) String() string {
+	return fmt.Sprintf("%s: %d bytes, sector size %d logical, %d physical", g.Source, g.Size, g.Logical, g.Physical)
+}
+
+// Compare the values of this geometry against the given reference and describe every disagreement
+func (g Geometry) Disagreements(ref Geometry) []string {
+	ret := make([]string, 0)
+	if g.Size != 0 && ref.Size != 0 && g.Size != ref.Size {
+		ret = append(ret, fmt.Sprintf("%s reports a disk size of %d bytes, %s reports %d bytes", g.Source, g.Size, ref.Source, ref.Size))
+	}
+	if g.Logical != 0 && ref.Logical != 0 && g.Logical != ref.Logical {
+		ret = append(ret, fmt.Sprintf("%s reports a logical sector size of %d, %s reports %d", g.Source, g.Logical, ref.Source, ref.Logical))
+	}
+	if g.Physical != 0 && ref.Physical != 0 && g.Physical != ref.Physical {
+		ret = append(ret, fmt.Sprintf("%s reports a physical sector size of %d, %s reports %d", g.Source, g.Physical, ref.Source, ref.Physical))
+	}
+	return ret
+}
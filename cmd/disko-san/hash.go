@@ -0,0 +1,60 @@
+/* Chunk hash algorithms for disko-san */
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+)
+
+// Hash algorithm of the chunk digest
+type HashType int
+
+const (
+	HASH_NONE   HashType = 0 // No selectable hash (version 1 chunks with fixed CRC32)
+	HASH_CRC32C HashType = 1 // CRC32 with the Castagnoli polynomial
+	HASH_FNV64  HashType = 2 // 64-bit FNV-1a, non-cryptographic
+	HASH_SHA256 HashType = 3 // SHA-256
+)
+
+const DEFAULT_HASH = HASH_CRC32C
+
+var hashNames = map[HashType]string{
+	HASH_CRC32C: "crc32c",
+	HASH_FNV64:  "fnv64",
+	HASH_SHA256: "sha256",
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+func ParseHashType(name string) (HashType, error) {
+	for t, n := range hashNames {
+		if n == name {
+			return t, nil
+		}
+	}
+	return HASH_NONE, fmt.Errorf("unknown hash '%s'", name)
+}
+
+func (t HashType) String() string {
+	if name, ok := hashNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("hash(%d)", int(t))
+}
+
+// Create a new hash instance of the given type or nil, if the type is unknown
+func (t HashType) New() hash.Hash {
+	switch t {
+	case HASH_CRC32C:
+		return crc32.New(crc32c)
+	case HASH_FNV64:
+		return fnv.New64a()
+	case HASH_SHA256:
+		return sha256.New()
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,155 @@
+/* On-disk run header for disko-san */
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+/* Run header layout
+ *
+ * The header is written to the first sector of the disk, which belongs to the first chunk and is never tested.
+ * Version 1 (512 bytes, little endian):
+ *   0..14     DISKMAGIC
+ *   14        header version
+ *   16..32    run ID
+ *   32..40    start time (unix nanoseconds)
+ *   40..48    chunk size
+ *   48..56    run seed
+ *   56        hash type
+ *   60..64    sector size of the per-sector checksums
+ *   64..72    disk size
+ *   72..104   tool version, zero padded
+ *   104..168  host name, zero padded
+ *   168..424  passes as in the progress file, zero padded
+ *   508..512  CRC32C over bytes 0..508
+ *
+ * Older versions only wrote DISKMAGIC (version 0). The bytes behind it hold whatever was on the disk before, so a
+ * version 1 header is only accepted, if its version byte and its checksum match.
+ */
+const DISKHEADER_SIZE = 512
+const DISKHEADER_VERSION = 1
+const DISKHEADER_PASSES = 256 // Space for the passes in the header, longer pass lists are refused
+
+// Run header at the beginning of the disk
+type DiskHeader struct {
+	Version   int       // Header version (0 = magic only, by older versions)
+	RunID     RunID     // Run ID, also stored in the chunk headers
+	Started   time.Time // Start time of the run
+	ChunkSize int
+	Seed      int64
+	Hash      HashType
+	Sectors   int    // Sector size of the per-sector checksums (0 = disabled)
+	Size      int64  // Disk size
+	Tool      string // Version of disko-san, which started the run
+	Host      string // Host name of the machine, which started the run
+	Passes    string // Write/read passes
+}
+
+// Create the header for the given run
+func NewDiskHeader(progress *Progress, host string) DiskHeader {
+	return DiskHeader{
+		Version:   DISKHEADER_VERSION,
+		RunID:     progress.RunID,
+		Started:   time.Now(),
+		ChunkSize: progress.ChunkSize,
+		Seed:      progress.Seed,
+		Hash:      progress.Hash,
+		Sectors:   progress.Sectors,
+		Size:      progress.Size,
+		Tool:      VERSION,
+		Host:      host,
+		Passes:    FormatPasses(progress.Passes),
+	}
+}
+
+// Copy the given string zero padded into the buffer, truncated if too long
+func putString(buf []byte, str string) {
+	n := copy(buf, str)
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+}
+
+// Get a zero padded string
+func getString(buf []byte) string {
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	return string(buf)
+}
+
+// Write the header into the given buffer of at least DISKHEADER_SIZE bytes
+func (h DiskHeader) Encode(buf []byte) {
+	for i := 0; i < DISKHEADER_SIZE; i++ {
+		buf[i] = 0
+	}
+	copy(buf, DISKMAGIC)
+	buf[14] = DISKHEADER_VERSION
+	copy(buf[16:32], h.RunID[:])
+	binary.LittleEndian.PutUint64(buf[32:], uint64(h.Started.UnixNano()))
+	binary.LittleEndian.PutUint64(buf[40:], uint64(h.ChunkSize))
+	binary.LittleEndian.PutUint64(buf[48:], uint64(h.Seed))
+	buf[56] = byte(h.Hash)
+	binary.LittleEndian.PutUint32(buf[60:], uint32(h.Sectors))
+	binary.LittleEndian.PutUint64(buf[64:], uint64(h.Size))
+	putString(buf[72:104], h.Tool)
+	putString(buf[104:168], h.Host)
+	putString(buf[168:168+DISKHEADER_PASSES], h.Passes)
+	binary.LittleEndian.PutUint32(buf[508:], crc32.Checksum(buf[:508], crc32c))
+}
+
+/* Parse the header at the beginning of the given buffer.
+ * Everything behind the magic, which is not a valid version 1 header, is a header of an older version (magic only)
+ */
+func ParseDiskHeader(buf []byte) (DiskHeader, error) {
+	var h DiskHeader
+	if !isDiskMagic(buf) {
+		return h, fmt.Errorf("no disko-san header")
+	}
+	if len(buf) < DISKHEADER_SIZE || buf[14] != DISKHEADER_VERSION {
+		return h, nil
+	}
+	if binary.LittleEndian.Uint32(buf[508:]) != crc32.Checksum(buf[:508], crc32c) {
+		return h, nil
+	}
+	h.Version = DISKHEADER_VERSION
+	copy(h.RunID[:], buf[16:32])
+	h.Started = time.Unix(0, int64(binary.LittleEndian.Uint64(buf[32:])))
+	h.ChunkSize = int(binary.LittleEndian.Uint64(buf[40:]))
+	h.Seed = int64(binary.LittleEndian.Uint64(buf[48:]))
+	h.Hash = HashType(buf[56])
+	h.Sectors = int(binary.LittleEndian.Uint32(buf[60:]))
+	h.Size = int64(binary.LittleEndian.Uint64(buf[64:]))
+	h.Tool = getString(buf[72:104])
+	h.Host = getString(buf[104:168])
+	h.Passes = getString(buf[168 : 168+DISKHEADER_PASSES])
+	return h, nil
+}
+
+func (h DiskHeader) Print() {
+	if h.Version == 0 {
+		fmt.Println("Header:     version 0 (written by an older version of disko-san, magic bytes only)")
+		return
+	}
+	passes := h.Passes
+	if passes == "" {
+		passes = "random"
+	}
+	fmt.Printf("Header:     version %d\n", h.Version)
+	fmt.Printf("Run ID:     %s\n", h.RunID)
+	fmt.Printf("Started:    %s\n", h.Started.Format(time.RFC3339))
+	fmt.Printf("Host:       %s\n", h.Host)
+	fmt.Printf("Tool:       disko-san %s\n", h.Tool)
+	fmt.Printf("Disk size:  %s (%d bytes)\n", gibistr(float32(h.Size)), h.Size)
+	fmt.Printf("Chunk size: %s (%d bytes)\n", gibistr(float32(h.ChunkSize)), h.ChunkSize)
+	fmt.Printf("Seed:       %d\n", h.Seed)
+	fmt.Printf("Hash:       %s\n", h.Hash)
+	if h.Sectors != 0 {
+		fmt.Printf("Sectors:    %d bytes with own checksum\n", h.Sectors)
+	}
+	fmt.Printf("Passes:     %s\n", passes)
+}
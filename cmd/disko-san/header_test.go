@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run header with every field set
+func testHeader() DiskHeader {
+	h := DiskHeader{
+		Version:   DISKHEADER_VERSION,
+		Started:   time.Unix(0, 1600000000123456789),
+		ChunkSize: DEFAULT_CHUNKSIZE,
+		Seed:      -0x1337,
+		Hash:      HASH_SHA256,
+		Sectors:   4096,
+		Size:      1 << 40,
+		Tool:      "1.2.3",
+		Host:      "testhost",
+		Passes:    "0x00,0xff,random",
+	}
+	for i := range h.RunID {
+		h.RunID[i] = byte(i)
+	}
+	return h
+}
+
+// Encoded headers parse back into the same header, unless they are corrupted
+func TestDiskHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(buf []byte)
+		version int // 0 = parsed as magic only header of an older version
+		valid   bool
+	}{
+		{"intact", func(buf []byte) {}, DISKHEADER_VERSION, true},
+		{"corrupt field", func(buf []byte) { buf[40]++ }, 0, true},
+		{"corrupt host", func(buf []byte) { buf[110]++ }, 0, true},
+		{"corrupt checksum", func(buf []byte) { buf[510]++ }, 0, true},
+		{"unknown version", func(buf []byte) { buf[14] = DISKHEADER_VERSION + 1 }, 0, true},
+		{"magic only", func(buf []byte) {
+			for i := len(DISKMAGIC); i < len(buf); i++ {
+				buf[i] = 0xaa
+			}
+		}, 0, true},
+		{"no magic", func(buf []byte) { buf[10]++ }, 0, false},
+	}
+	expected := testHeader()
+	for _, test := range tests {
+		buf := make([]byte, 4096)
+		for i := range buf {
+			buf[i] = 0xaa // Data behind the header is left alone
+		}
+		expected.Encode(buf)
+		if buf[DISKHEADER_SIZE] != 0xaa {
+			t.Fatalf("header exceeds %d bytes", DISKHEADER_SIZE)
+		}
+		test.corrupt(buf)
+		h, err := ParseDiskHeader(buf)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: header accepted", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if h.Version != test.version {
+			t.Errorf("%s: header version %d, expected %d", test.name, h.Version, test.version)
+		} else if h.Version == DISKHEADER_VERSION && !reflect.DeepEqual(h, expected) {
+			t.Errorf("%s: parsed as %+v, expected %+v", test.name, h, expected)
+		}
+	}
+}
+
+// Strings, which exceed their field, are truncated
+func TestDiskHeaderTruncation(t *testing.T) {
+	h := testHeader()
+	h.Host = strings.Repeat("h", 100)
+	buf := make([]byte, DISKHEADER_SIZE)
+	h.Encode(buf)
+	parsed, err := ParseDiskHeader(buf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if parsed.Host != h.Host[:64] {
+		t.Errorf("host '%s', expected '%s'", parsed.Host, h.Host[:64])
+	}
+}
@@ -0,0 +1,168 @@
+/* Disk identity and confirmation before destructive writes for disko-san */
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const SIGNATURE_AREA = 68 * 1024 // Size of the area at the beginning of a disk or partition to look for signatures
+
+// Identity of a block device, as shown before destructive writes
+type DiskIdentity struct {
+	Name       string      // Kernel name, e.g. sda
+	Model      string      // Vendor and model
+	Serial     string      // Serial number (empty, if unknown)
+	WWN        string      // World wide name (empty, if unknown)
+	Transport  string      // e.g. sata, nvme, usb or virtual
+	Size       int64       // Disk size in bytes
+	Signatures []string    // Partition table and filesystem signatures found on the disk
+	Partitions []Partition // Partitions of the disk
+}
+
+// Partition of a block device
+type Partition struct {
+	Name       string
+	Start      int64 // Start position in bytes
+	Size       int64 // Size in bytes
+	Signatures []string
+}
+
+// Check if the buffer holds the given magic at the given offset
+func hasMagic(buf []byte, offset int, magic string) bool {
+	return len(buf) >= offset+len(magic) && string(buf[offset:offset+len(magic)]) == magic
+}
+
+/* Find well-known partition table and filesystem signatures at the beginning of a disk or partition.
+ * The buffer should hold the first SIGNATURE_AREA bytes, the sector size is needed for the GPT header
+ */
+func Signatures(buf []byte, sectorSize int) []string {
+	ret := make([]string, 0)
+	if isDiskMagic(buf) {
+		ret = append(ret, "disko-san")
+	}
+	if hasMagic(buf, sectorSize, "EFI PART") {
+		ret = append(ret, "gpt")
+	} else if hasMagic(buf, 510, "\x55\xaa") && !hasMagic(buf, 3, "NTFS    ") && !hasMagic(buf, 82, "FAT32") && !hasMagic(buf, 54, "FAT1") {
+		ret = append(ret, "dos")
+	}
+	if len(buf) >= 1082 && binary.LittleEndian.Uint16(buf[1080:]) == 0xef53 {
+		ret = append(ret, "ext2/3/4")
+	}
+	if hasMagic(buf, 0, "XFSB") {
+		ret = append(ret, "xfs")
+	}
+	if hasMagic(buf, 0x10040, "_BHRfS_M") {
+		ret = append(ret, "btrfs")
+	}
+	if hasMagic(buf, 0, "LUKS\xba\xbe") {
+		ret = append(ret, "crypto_LUKS")
+	}
+	if hasMagic(buf, 3, "NTFS    ") {
+		ret = append(ret, "ntfs")
+	}
+	if hasMagic(buf, 82, "FAT32") || hasMagic(buf, 54, "FAT1") {
+		ret = append(ret, "vfat")
+	}
+	if hasMagic(buf, 32769, "CD001") {
+		ret = append(ret, "iso9660")
+	}
+	if len(buf) >= 4100 && binary.LittleEndian.Uint32(buf[4096:]) == 0xa92b4efc {
+		ret = append(ret, "linux_raid_member")
+	}
+	for _, pageSize := range []int{4096, 8192, 16384, 65536} {
+		if hasMagic(buf, pageSize-10, "SWAPSPACE2") || hasMagic(buf, pageSize-10, "SWAP-SPACE") {
+			ret = append(ret, "swap")
+			break
+		}
+	}
+	// The LVM2 label is in one of the first four 512 byte sectors
+	for i := 0; i < 4; i++ {
+		if hasMagic(buf, i*512, "LABELONE") && hasMagic(buf, i*512+24, "LVM2") {
+			ret = append(ret, "LVM2_member")
+			break
+		}
+	}
+	return ret
+}
+
+// Read the signature area at the given disk position
+func (d *Disk) readSignatures(pos int64) ([]string, error) {
+	size := int64(SIGNATURE_AREA)
+	if pos+size > d.size {
+		size = (d.size - pos) / int64(d.logical) * int64(d.logical)
+	}
+	if size <= 0 {
+		return nil, nil
+	}
+	buf := alignedBuffer(int(size), DIRECT_ALIGNMENT)
+	if _, err := d.f.ReadAt(buf, pos); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return Signatures(buf, d.logical), nil
+}
+
+func (id DiskIdentity) Print() {
+	unknown := func(str string) string {
+		if str == "" {
+			return "(unknown)"
+		}
+		return str
+	}
+	fmt.Printf("Disk:       %s\n", id.Name)
+	fmt.Printf("Model:      %s\n", unknown(id.Model))
+	fmt.Printf("Serial:     %s\n", unknown(id.Serial))
+	fmt.Printf("WWN:        %s\n", unknown(id.WWN))
+	fmt.Printf("Transport:  %s\n", unknown(id.Transport))
+	fmt.Printf("Size:       %s (%d bytes)\n", gibistr(float32(id.Size)), id.Size)
+	if len(id.Signatures) > 0 {
+		fmt.Printf("Signatures: %s\n", strings.Join(id.Signatures, ", "))
+	} else {
+		fmt.Printf("Signatures: none\n")
+	}
+	for _, part := range id.Partitions {
+		signatures := "no signature"
+		if len(part.Signatures) > 0 {
+			signatures = strings.Join(part.Signatures, ", ")
+		}
+		fmt.Printf("  %s: %s at %d (%s)\n", part.Name, gibistr(float32(part.Size)), part.Start, signatures)
+	}
+}
+
+// The text the user needs to type to confirm: The last four characters of the serial number or the disk name
+func (id DiskIdentity) ConfirmationText() string {
+	serial := strings.TrimSpace(id.Serial)
+	if serial == "" {
+		return id.Name
+	}
+	if len(serial) > 4 {
+		return serial[len(serial)-4:]
+	}
+	return serial
+}
+
+/* Show the disk identity and ask the user to confirm the destruction of all data on it.
+ * Returns nil, if the user typed the confirmation text
+ */
+func ConfirmDestruction(id DiskIdentity, in io.Reader) error {
+	fmt.Println("ALL DATA ON THIS DISK WILL BE DESTROYED:")
+	id.Print()
+	text := id.ConfirmationText()
+	if strings.TrimSpace(id.Serial) == "" {
+		fmt.Printf("Type the disk name (%s) to continue: ", text)
+	} else {
+		fmt.Printf("Type the last four characters of the serial number to continue: ")
+	}
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		fmt.Println()
+		return fmt.Errorf("no confirmation (use --yes-i-know for non-interactive runs)")
+	}
+	if strings.TrimSpace(line) != text {
+		return fmt.Errorf("confirmation mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+/* Disk identity on Linux */
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Read a sysfs attribute as string, or an empty string if not present
+func readSysfsString(filename string) string {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(buf))
+}
+
+// Get the serial number of the disk from its sysfs device directory
+func sysfsSerial(device string) string {
+	if serial := readSysfsString(filepath.Join(device, "serial")); serial != "" {
+		return serial
+	}
+	// SCSI and SATA disks have the serial number in the unit serial number VPD page
+	buf, err := ioutil.ReadFile(filepath.Join(device, "vpd_pg80"))
+	if err != nil || len(buf) < 4 {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint16(buf[2:]))
+	if n > len(buf)-4 {
+		n = len(buf) - 4
+	}
+	return strings.TrimSpace(string(buf[4 : 4+n]))
+}
+
+// Guess the transport of the disk from its sysfs path
+func sysfsTransport(dir string) string {
+	transports := []struct{ path, name string }{
+		{"/nvme/", "nvme"},
+		{"/usb", "usb"},
+		{"/ata", "sata"},
+		{"/virtio", "virtio"},
+		{"/mmc_host/", "mmc"},
+		{"/devices/virtual/", "virtual"},
+		{"/host", "scsi"},
+	}
+	for _, t := range transports {
+		if strings.Contains(dir, t.path) {
+			return t.name
+		}
+	}
+	return ""
+}
+
+/* Get the identity of the disk for the confirmation before destructive writes.
+ * Returns false, if the disk is not a block device, e.g. an image file
+ */
+func (d *Disk) Identity() (DiskIdentity, bool, error) {
+	id := DiskIdentity{Name: filepath.Base(d.path), Size: d.size}
+	if block, err := d.isBlockDevice(); err != nil || !block {
+		return id, false, err
+	}
+	devs, err := d.blockDevs()
+	if err != nil {
+		return id, true, err
+	}
+	id.Name = devs[0].name
+	// Model and serial number belong to the whole disk, also when testing a single partition
+	disk := devs[0].dir
+	if fileExists(filepath.Join(disk, "partition")) {
+		disk = filepath.Dir(disk)
+	}
+	id.Model = strings.TrimSpace(readSysfsString(filepath.Join(disk, "device", "vendor")) + " " + readSysfsString(filepath.Join(disk, "device", "model")))
+	id.Serial = sysfsSerial(filepath.Join(disk, "device"))
+	if id.WWN = readSysfsString(filepath.Join(disk, "wwid")); id.WWN == "" {
+		id.WWN = readSysfsString(filepath.Join(disk, "device", "wwid"))
+	}
+	id.Transport = sysfsTransport(disk)
+	if id.Signatures, err = d.readSignatures(0); err != nil {
+		return id, true, err
+	}
+	for _, dev := range devs[1:] {
+		part := Partition{Name: dev.name}
+		if start, err := readSysfsInt(filepath.Join(dev.dir, "start")); err == nil {
+			part.Start = start * 512 // sysfs always counts 512 byte sectors
+		}
+		if size, err := readSysfsInt(filepath.Join(dev.dir, "size")); err == nil {
+			part.Size = size * 512
+		}
+		if part.Signatures, err = d.readSignatures(part.Start); err != nil {
+			return id, true, err
+		}
+		id.Partitions = append(id.Partitions, part)
+	}
+	return id, true, nil
+}
@@ -0,0 +1,206 @@
+/* Check if a disk is in use on Linux */
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Block device, which belongs to the disk under test
+type blockDev struct {
+	name string // Kernel name, e.g. sda1
+	dev  string // Device number as major:minor
+	dir  string // sysfs directory
+}
+
+// Get the block device and all of its partitions
+func (d *Disk) blockDevs() ([]blockDev, error) {
+	dir, err := d.sysfsDir()
+	if err != nil {
+		return nil, err
+	}
+	return sysfsBlockDevs(dir)
+}
+
+// Get the block device in the given sysfs directory
+func sysfsBlockDev(dir string) (blockDev, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "dev"))
+	if err != nil {
+		return blockDev{}, err
+	}
+	return blockDev{name: filepath.Base(dir), dev: strings.TrimSpace(string(buf)), dir: dir}, nil
+}
+
+// Get the block device in the given sysfs directory and all of its partitions
+func sysfsBlockDevs(dir string) ([]blockDev, error) {
+	devs := make([]blockDev, 0)
+	add := func(dir string) error {
+		dev, err := sysfsBlockDev(dir)
+		if err != nil {
+			return err
+		}
+		devs = append(devs, dev)
+		return nil
+	}
+	if err := add(dir); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		part := filepath.Join(dir, entry.Name())
+		if entry.IsDir() && fileExists(filepath.Join(part, "partition")) {
+			if err := add(part); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return devs, nil
+}
+
+// Find the block device with the given kernel name or device path, e.g. /dev/sda1
+func findBlockDev(devs []blockDev, path string) *blockDev {
+	name := filepath.Base(path)
+	for i := range devs {
+		if devs[i].name == name {
+			return &devs[i]
+		}
+	}
+	return nil
+}
+
+// Find mounted filesystems on the given block devices
+func mountedDevs(devs []blockDev) ([]string, error) {
+	f, err := os.Open(filepath.Join(PROC_ROOT, "self", "mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// ID PARENT MAJOR:MINOR ROOT MOUNTPOINT OPTIONS [OPTIONAL FIELDS...] - FSTYPE SOURCE SUPEROPTIONS
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		var dev *blockDev
+		for i := range devs {
+			if devs[i].dev == fields[2] {
+				dev = &devs[i]
+			}
+		}
+		// Some filesystems (e.g. btrfs) use anonymous device numbers, but still name their source device
+		for i := 6; dev == nil && i+2 < len(fields); i++ {
+			if fields[i] == "-" && strings.HasPrefix(fields[i+2], "/dev/") {
+				dev = findBlockDev(devs, fields[i+2])
+			}
+		}
+		if dev != nil {
+			ret = append(ret, fmt.Sprintf("%s is mounted at %s", dev.name, fields[4]))
+		}
+	}
+	return ret, scanner.Err()
+}
+
+// Find active swap areas on the given block devices
+func swapDevs(devs []blockDev) ([]string, error) {
+	f, err := os.Open(filepath.Join(PROC_ROOT, "swaps"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Skip header line
+	for scanner.Scan() {
+		// Filename Type Size Used Priority
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[1] != "partition" {
+			continue // Swap files are covered by the mounts
+		}
+		if dev := findBlockDev(devs, fields[0]); dev != nil {
+			ret = append(ret, fmt.Sprintf("%s is an active swap device", dev.name))
+		}
+	}
+	return ret, scanner.Err()
+}
+
+// Find holders of the given block devices, i.e. device mapper (LVM, dm-crypt) or md devices built on top of them
+func heldDevs(devs []blockDev) ([]string, error) {
+	ret := make([]string, 0)
+	for _, dev := range devs {
+		entries, err := ioutil.ReadDir(filepath.Join(dev.dir, "holders"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return ret, err
+		}
+		for _, entry := range entries {
+			ret = append(ret, fmt.Sprintf("%s is held by %s", dev.name, entry.Name()))
+		}
+	}
+	return ret, nil
+}
+
+/* Check if the disk or any of its partitions is in use, i.e. mounted, an active swap device or held by another
+ * device like a LVM, md or dm-crypt device. Returns the descriptions of all uses. Regular files are never in use
+ */
+func (d *Disk) InUse() ([]string, error) {
+	if block, err := d.isBlockDevice(); err != nil {
+		return nil, err
+	} else if !block {
+		return nil, nil
+	}
+	dev, err := d.devNumber()
+	if err != nil {
+		return nil, err
+	}
+	return blockDevInUse(dev)
+}
+
+/* Check if the block device with the given device number (major:minor) or any of its partitions is in use.
+ * For a partition, the whole disk is checked as well
+ */
+func blockDevInUse(dev string) ([]string, error) {
+	dir, err := sysfsDevDir(dev)
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine partitions: %s", err)
+	}
+	devs, err := sysfsBlockDevs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine partitions: %s", err)
+	}
+	// A partition is in use as well, if the whole disk is
+	if fileExists(filepath.Join(dir, "partition")) {
+		parent, err := sysfsBlockDev(filepath.Dir(dir))
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine the disk of the partition: %s", err)
+		}
+		devs = append(devs, parent)
+	}
+	uses := make([]string, 0)
+	if ret, err := mountedDevs(devs); err != nil {
+		return nil, fmt.Errorf("cannot read mounts: %s", err)
+	} else {
+		uses = append(uses, ret...)
+	}
+	if ret, err := swapDevs(devs); err != nil {
+		return nil, fmt.Errorf("cannot read swaps: %s", err)
+	} else {
+		uses = append(uses, ret...)
+	}
+	if ret, err := heldDevs(devs); err != nil {
+		return nil, fmt.Errorf("cannot read holders: %s", err)
+	} else {
+		uses = append(uses, ret...)
+	}
+	return uses, nil
+}
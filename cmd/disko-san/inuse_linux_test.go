@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Device numbers of the fixture devices and their sysfs directories below sys/devices
+var fixtureDevs = map[string]string{
+	"8:0":  "ata1/block/sda",
+	"8:1":  "ata1/block/sda/sda1",
+	"8:2":  "ata1/block/sda/sda2",
+	"8:3":  "ata1/block/sda/sda3",
+	"8:16": "ata2/block/sdb",
+	"8:17": "ata2/block/sdb/sdb1",
+	"8:32": "ata3/block/sdc",
+	"8:33": "ata3/block/sdc/sdc1",
+	"8:48": "ata4/block/sdd",
+	"8:49": "ata4/block/sdd/sdd1",
+	"8:64": "ata5/block/sde",
+	"8:65": "ata5/block/sde/sde1",
+}
+
+/* Copy the fixture tree in testdata/sysroot to a temporary directory and add the sys/dev/block links.
+ * The links are named after the device numbers and can't be part of the repository, as file names of Go modules must
+ * not contain colons
+ */
+func fixtureSysroot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "disko-san-sysroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join("testdata", "sysroot")
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(root, rel), 0755)
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(root, rel), buf, 0644)
+	})
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	links := filepath.Join(root, "sys", "dev", "block")
+	if err := os.MkdirAll(links, 0755); err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	for dev, dir := range fixtureDevs {
+		if err := os.Symlink(filepath.Join("..", "..", "devices", dir), filepath.Join(links, dev)); err != nil {
+			os.RemoveAll(root)
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestBlockDevInUse(t *testing.T) {
+	root := fixtureSysroot(t)
+	defer os.RemoveAll(root)
+	sysfs, proc := SYSFS_ROOT, PROC_ROOT
+	SYSFS_ROOT, PROC_ROOT = filepath.Join(root, "sys"), filepath.Join(root, "proc")
+	defer func() { SYSFS_ROOT, PROC_ROOT = sysfs, proc }()
+
+	tests := []struct {
+		name string
+		dev  string
+		uses []string
+	}{
+		// sda2 holds a btrfs filesystem, which is mounted with an anonymous device number
+		{"whole disk with used partitions", "8:0", []string{"sda2 is mounted at /data", "sda3 is an active swap device", "sda1 is held by dm-0"}},
+		{"mounted whole disk", "8:16", []string{"sdb is mounted at /mnt/usb"}},
+		{"partition held by a device mapper", "8:1", []string{"sda1 is held by dm-0"}},
+		{"partition with btrfs", "8:2", []string{"sda2 is mounted at /data"}},
+		{"swap partition", "8:3", []string{"sda3 is an active swap device"}},
+		// Uses of the whole disk affect its partitions as well
+		{"partition of a mounted disk", "8:17", []string{"sdb is mounted at /mnt/usb"}},
+		{"partition of a swap disk", "8:49", []string{"sdd is an active swap device"}},
+		{"partition of a held disk", "8:65", []string{"sde is held by md0"}},
+		{"unused disk", "8:32", []string{}},
+		{"unused partition", "8:33", []string{}},
+	}
+	for _, test := range tests {
+		uses, err := blockDevInUse(test.dev)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !reflect.DeepEqual(uses, test.uses) {
+			t.Errorf("%s: got %q, expected %q", test.name, uses, test.uses)
+		}
+	}
+
+	if _, err := blockDevInUse("9:9"); err == nil {
+		t.Errorf("unknown device: no error")
+	}
+}
@@ -0,0 +1,116 @@
+/* Crash-safe backup of the chunk under test in the non-destructive mode of disko-san */
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+/* Journal layout (little endian):
+ *   0..16   JOURNAL_MAGIC
+ *   16..24  disk position of the chunk
+ *   24..32  size of the chunk
+ *   32..36  CRC32C of the chunk data
+ *   36..40  CRC32C over bytes 0..36
+ *   40..    original chunk data
+ * An empty journal holds no chunk. A journal, which does not verify, was torn while saving it. In this case the chunk
+ * itself has not been touched yet, as it is only overwritten after the journal is synced
+ */
+const JOURNAL_MAGIC = "disko-san-jrnl-1"
+const JOURNAL_HEADER = 40
+
+// Journal file with the original data of the chunk under test
+type Journal struct {
+	filename string
+	f        *os.File
+}
+
+func (j *Journal) Open(filename string) error {
+	var err error
+	j.f, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		j.f = nil
+		return err
+	}
+	j.filename = filename
+	return nil
+}
+
+func (j *Journal) Close() error {
+	if j.f != nil {
+		err := j.f.Close()
+		j.f = nil
+		return err
+	}
+	return nil
+}
+
+// Save the original data of the chunk at the given disk position and sync it to stable storage
+func (j *Journal) Save(pos int64, data []byte) error {
+	buf := make([]byte, JOURNAL_HEADER+len(data))
+	copy(buf, JOURNAL_MAGIC)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(pos))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(len(data)))
+	binary.LittleEndian.PutUint32(buf[32:], crc32.Checksum(data, crc32c))
+	binary.LittleEndian.PutUint32(buf[36:], crc32.Checksum(buf[:36], crc32c))
+	copy(buf[JOURNAL_HEADER:], data)
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.f.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+/* Load the saved chunk. Returns false, if the journal is empty or was torn while saving it.
+ * Both mean that no chunk needs to be restored
+ */
+func (j *Journal) Load() (int64, []byte, bool, error) {
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, false, err
+	}
+	buf, err := ioutil.ReadAll(j.f)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if len(buf) < JOURNAL_HEADER || string(buf[:16]) != JOURNAL_MAGIC {
+		return 0, nil, false, nil
+	}
+	if binary.LittleEndian.Uint32(buf[36:]) != crc32.Checksum(buf[:36], crc32c) {
+		return 0, nil, false, nil
+	}
+	pos := int64(binary.LittleEndian.Uint64(buf[16:]))
+	size := int64(binary.LittleEndian.Uint64(buf[24:]))
+	if size != int64(len(buf)-JOURNAL_HEADER) {
+		return 0, nil, false, nil
+	}
+	data := buf[JOURNAL_HEADER:]
+	if binary.LittleEndian.Uint32(buf[32:]) != crc32.Checksum(data, crc32c) {
+		return 0, nil, false, nil
+	}
+	return pos, data, true, nil
+}
+
+// Clear the journal, after the original chunk has been restored
+func (j *Journal) Clear() error {
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// Close and remove the journal, after the run is completed
+func (j *Journal) Remove() error {
+	if err := j.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(j.filename); err != nil {
+		return fmt.Errorf("cannot remove journal: %s", err)
+	}
+	return nil
+}
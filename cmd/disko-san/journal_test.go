@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Create a journal in the given directory with a saved chunk of 4096 bytes at disk position 8192
+func savedJournal(t *testing.T, dir string) (*Journal, []byte) {
+	var journal Journal
+	if err := journal.Open(filepath.Join(dir, "journal")); err != nil {
+		t.Fatalf("cannot open journal: %s", err)
+	}
+	data := make([]byte, 4096)
+	FillPattern(data, 0x1337, 8192)
+	if err := journal.Save(8192, data); err != nil {
+		t.Fatalf("cannot save chunk: %s", err)
+	}
+	return &journal, data
+}
+
+/* A journal, which was torn while saving it, must not be restored, as the chunk itself is only overwritten after the
+ * journal is synced. Every test tears the journal in a different place
+ */
+func TestJournalLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		tear     func(buf []byte) []byte
+		restored bool
+	}{
+		{"complete", func(buf []byte) []byte { return buf }, true},
+		{"empty", func(buf []byte) []byte { return buf[:0] }, false},
+		{"torn magic", func(buf []byte) []byte { return buf[:8] }, false},
+		{"torn header", func(buf []byte) []byte { return buf[:JOURNAL_HEADER-4] }, false},
+		{"header only", func(buf []byte) []byte { return buf[:JOURNAL_HEADER] }, false},
+		{"torn data", func(buf []byte) []byte { return buf[:JOURNAL_HEADER+2048] }, false},
+		{"zeroed data", func(buf []byte) []byte {
+			for i := JOURNAL_HEADER + 2048; i < len(buf); i++ {
+				buf[i] = 0
+			}
+			return buf
+		}, false},
+		{"corrupt position", func(buf []byte) []byte { buf[16]++; return buf }, false},
+		{"corrupt size", func(buf []byte) []byte { buf[24]++; return buf }, false},
+		{"corrupt magic", func(buf []byte) []byte { buf[0]++; return buf }, false},
+	}
+	dir, err := ioutil.TempDir("", "disko-san")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range tests {
+		journal, data := savedJournal(t, dir)
+		buf, err := ioutil.ReadFile(journal.filename)
+		if err != nil {
+			t.Fatalf("cannot read journal: %s", err)
+		}
+		if err := ioutil.WriteFile(journal.filename, test.tear(buf), 0600); err != nil {
+			t.Fatalf("cannot write journal: %s", err)
+		}
+		pos, loaded, ok, err := journal.Load()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if ok != test.restored {
+			t.Errorf("%s: restored %v, expected %v", test.name, ok, test.restored)
+		} else if ok && (pos != 8192 || !bytes.Equal(loaded, data)) {
+			t.Errorf("%s: loaded a different chunk at %d", test.name, pos)
+		}
+		journal.Close()
+	}
+}
+
+// A cleared journal holds no chunk
+func TestJournalClear(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disko-san")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	journal, _ := savedJournal(t, dir)
+	defer journal.Close()
+	if err := journal.Clear(); err != nil {
+		t.Fatalf("cannot clear journal: %s", err)
+	}
+	if _, _, ok, err := journal.Load(); err != nil || ok {
+		t.Errorf("cleared journal restored (%v)", err)
+	}
+}
@@ -0,0 +1,84 @@
+/* Performance log, errors file and progress line of the test steps for disko-san */
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Performance log and errors file of a test step, both optional
+type StepLogs struct {
+	stats  *os.File // stats file, if present
+	errlog ErrorLog
+}
+
+// Open the performance log for appending and the errors file. Empty filenames are skipped
+func OpenStepLogs(statsFile string, errorsFile string) (*StepLogs, error) {
+	l := &StepLogs{}
+	if statsFile != "" {
+		exists := fileExists(statsFile)
+		stats, err := os.OpenFile(statsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening stats file : %s", err)
+		}
+		// Write stats file header only once
+		if !exists {
+			if _, err := stats.Write([]byte("# disko-san performance metrics file\nPosition [B], Size [B], Millis [ms]\n\n")); err != nil {
+				stats.Close()
+				return nil, fmt.Errorf("Error writing header to stats file : %s", err)
+			}
+		}
+		l.stats = stats
+	}
+	if errorsFile != "" {
+		if err := l.errlog.Open(errorsFile); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("Error opening errors file : %s", err)
+		}
+	}
+	return l, nil
+}
+
+func (l *StepLogs) Close() {
+	if l.stats != nil {
+		l.stats.Close()
+		l.stats = nil
+	}
+	l.errlog.Close()
+}
+
+// Append the runtime of the chunk at the given position to the performance log, if present
+func (l *StepLogs) WriteStats(pos int64, size int64, millis int64) error {
+	if l.stats == nil {
+		return nil
+	}
+	line := fmt.Sprintf("%d,%d,%d\n", pos, size, millis)
+	if _, err := l.stats.Write([]byte(line)); err != nil {
+		return fmt.Errorf("Error writing to stats file: %s", err)
+	}
+	return nil
+}
+
+// Record the given failed chunk in the errors file, if present. A failing errors file doesn't stop the test
+func (l *StepLogs) WriteError(cerr *ChunkError) {
+	if err := l.errlog.Write(cerr); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing to errors file: %s\n", err)
+	}
+}
+
+// Remember the line of the progress output
+func startProgress() {
+	fmt.Printf("\033[s") // save cursor position
+}
+
+// Replace the progress output with the given percentage and the smoothed throughput
+func printProgress(action string, percent float32, throughput float32) {
+	clearProgress()
+	fmt.Printf("%s chunks: %.2f %% done @ %s/s", action, percent, gibistr(smooth(throughput, 0.75)))
+}
+
+// Clear the progress output
+func clearProgress() {
+	fmt.Printf("\033[u") // restore cursor position
+	fmt.Printf("\033[K") // erase rest of line
+}
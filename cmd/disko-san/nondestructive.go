@@ -0,0 +1,160 @@
+/* Non-destructive read-write test for disko-san */
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+/* Write the buffer to the given disk position, sync it and read it back into the second buffer.
+ * In buffered mode the chunk is dropped from the page cache before reading it back, as long as supported
+ */
+func writeReadBack(disk *Disk, pos int64, buf []byte, back []byte) error {
+	if n, err := disk.WriteAt(buf, pos); err != nil {
+		return fmt.Errorf("write error at %d: %s", pos, err)
+	} else if n != len(buf) {
+		return fmt.Errorf("short write at %d", pos)
+	}
+	if err := disk.Sync(); err != nil {
+		return err
+	}
+	disk.dropCacheBeforeRead(pos, int64(len(buf)))
+	if n, err := disk.ReadAt(back[:len(buf)], pos); err != nil {
+		return fmt.Errorf("read error at %d: %s", pos, err)
+	} else if n != len(buf) {
+		return fmt.Errorf("short read at %d", pos)
+	}
+	return nil
+}
+
+// Write the original data back to the given disk position and verify it
+func restoreChunk(disk *Disk, pos int64, data []byte, back []byte) error {
+	if err := writeReadBack(disk, pos, data, back); err != nil {
+		return err
+	}
+	if !bufCompare(back[:len(data)], data) {
+		return fmt.Errorf("verification of the restored data failed")
+	}
+	return nil
+}
+
+/* Test the disk like `badblocks -n`: Save the original data of every chunk in the journal, write and verify the test
+ * chunks of all passes, then restore and verify the original data. A chunk left in the journal by an interrupted run is
+ * restored first. If the original data of a chunk cannot be restored, the test stops and keeps the journal, so that
+ * the next run tries again.
+ * Warning: The disk must not be in use, as concurrent writes to a chunk under test are lost!
+ */
+func NonDestructiveCheck(disk *Disk, progress *Progress, journal *Journal, statsFile string, errorsFile string, budget ErrorBudget) error {
+	chunkSize := int64(progress.ChunkSize)
+	orig := alignedBuffer(int(chunkSize), DIRECT_ALIGNMENT)
+	test := alignedBuffer(int(chunkSize), DIRECT_ALIGNMENT)
+	back := alignedBuffer(int(chunkSize), DIRECT_ALIGNMENT)
+
+	logs, err := OpenStepLogs(statsFile, errorsFile)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+
+	// Put back the chunk, which was under test when the previous run was interrupted
+	if pos, data, ok, err := journal.Load(); err != nil {
+		return fmt.Errorf("Error reading journal: %s", err)
+	} else if ok {
+		fmt.Printf("Restoring the original data of chunk %d from the journal\n", pos/chunkSize)
+		if err := restoreChunk(disk, pos, data, alignedBuffer(len(data), DIRECT_ALIGNMENT)); err != nil {
+			return fmt.Errorf("cannot restore chunk %d from the journal: %s", pos/chunkSize, err)
+		}
+		if err := journal.Clear(); err != nil {
+			return fmt.Errorf("Error clearing journal: %s", err)
+		}
+	}
+
+	if progress.Pos == 0 {
+		progress.Pos = progress.RangeStart()
+	}
+	progress.Pos = progress.NextSample(progress.Pos)
+	end := progress.RangeEnd()
+
+	startProgress()
+	for progress.Pos < end {
+		if !running {
+			return fmt.Errorf("interrupted")
+		}
+		pos := progress.Pos
+		size := progress.ChunkSizeAt(pos) // at the ends of the range, the chunk might be smaller
+		start := time.Now()
+
+		// Save the original data. Unreadable chunks cannot be saved and are not written
+		var cerr *ChunkError
+		if n, err := disk.ReadAt(orig[:size], pos); err != nil || int64(n) != size {
+			if err == nil {
+				err = fmt.Errorf("short read at %d", pos)
+			}
+			fmt.Println()
+			fmt.Fprintf(os.Stderr, "Chunk %d read error (disk position %d, LBA %d): %v\n", pos/chunkSize, pos, pos/int64(disk.LogicalSectorSize()), err)
+			cerr = NewChunkError(pos, int(size), int(chunkSize), disk.LogicalSectorSize(), "read-error")
+		} else {
+			if err := journal.Save(pos, orig[:size]); err != nil {
+				return fmt.Errorf("Error writing journal: %s", err)
+			}
+			// Write and verify the test chunks of all passes
+			for i := 0; i < progress.PassCount() && cerr == nil; i++ {
+				params := progress.PassParams(i)
+				CreateChunk(test[:size], params, pos)
+				if err := writeReadBack(disk, pos, test[:size], back); err != nil {
+					fmt.Println()
+					fmt.Fprintf(os.Stderr, "Chunk %d: %s\n", pos/chunkSize, err)
+					cerr = NewChunkError(pos, int(size), int(chunkSize), disk.LogicalSectorSize(), "io-error")
+				} else if cerr = verifyReadChunk(pos, back[:size], test[:size], params, disk); cerr != nil {
+					printChunkError(cerr, back[:size], test[:size], params)
+				}
+			}
+			if err := restoreChunk(disk, pos, orig[:size], back); err != nil {
+				fmt.Println()
+				return fmt.Errorf("cannot restore the original data of chunk %d (%s), it is kept in the journal %s", pos/chunkSize, err, journal.filename)
+			}
+			if err := journal.Clear(); err != nil {
+				return fmt.Errorf("Error clearing journal: %s", err)
+			}
+		}
+		runtime := time.Since(start)
+
+		// Write performance stats
+		if err := logs.WriteStats(pos, size, runtime.Milliseconds()); err != nil {
+			return err
+		}
+
+		if cerr != nil {
+			logs.WriteError(cerr)
+			progress.AddBad(cerr)
+			checked := progress.SampledChunks(progress.RangeStart(), pos+size)
+			if budget.Exceeded(len(progress.Bad), checked) {
+				progress.WriteIfOpen()
+				if !budget.Continue {
+					return fmt.Errorf("chunk verification failed")
+				}
+				return fmt.Errorf("error budget exceeded (%d bad chunks out of %d)", len(progress.Bad), checked)
+			}
+		}
+
+		// Update progress
+		progress.Pos = progress.NextSample(pos + size)
+		if err := progress.WriteIfOpen(); err != nil {
+			return fmt.Errorf("Error writing progress file: %s", err)
+		}
+
+		// Print stats
+		throughput := float32(float64(size) / runtime.Seconds())
+		printProgress("Testing", progress.Percent(), throughput)
+	}
+
+	clearProgress()
+	if len(progress.Bad) > 0 {
+		fmt.Println()
+		return fmt.Errorf("%d bad chunks", len(progress.Bad))
+	}
+	fmt.Println("Non-destructive test successful")
+
+	return nil
+}
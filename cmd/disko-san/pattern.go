@@ -0,0 +1,127 @@
+/* Deterministic pattern generation for disko-san */
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// splitmix64 step function. Advances the given state and returns the next pseudo-random value
+func splitmix64(state *uint64) uint64 {
+	*state += 0x9e3779b97f4a7c15
+	z := *state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+/* Fill the given buffer with the deterministic pattern for the given run seed and disk offset.
+ * The same (seed, offset) pair always results in the same buffer content, which allows the read phase
+ * to rebuild the expected chunk and to replay a run bit-for-bit.
+ */
+func FillPattern(buf []byte, seed int64, offset int64) {
+	// Derive the generator state from the seed and the offset, so that every chunk has its own sequence
+	mix := uint64(offset)
+	state := uint64(seed) ^ splitmix64(&mix)
+	n := len(buf)
+	i := 0
+	for ; i+8 <= n; i += 8 {
+		binary.LittleEndian.PutUint64(buf[i:], splitmix64(&state))
+	}
+	// Remaining tail bytes
+	if i < n {
+		var tail [8]byte
+		binary.LittleEndian.PutUint64(tail[:], splitmix64(&state))
+		copy(buf[i:], tail[:])
+	}
+}
+
+// Fill the given buffer with random data from the system random pool
+func FillRandom(buf []byte) {
+	n, err := rand.Read(buf)
+	if err != nil {
+		// This error is critical and cannot be recovered
+		panic(err)
+	}
+	if n < len(buf) {
+		panic(fmt.Errorf("couldn't get enough bytes from random pool"))
+	}
+}
+
+// Create a new random run seed. The seed is never 0, as 0 denotes a run without seed
+func NewSeed() int64 {
+	var buf [8]byte
+	for {
+		FillRandom(buf[:])
+		if seed := int64(binary.LittleEndian.Uint64(buf[:])); seed != 0 {
+			return seed
+		}
+	}
+}
+
+// Fill the given buffer with the fixed pattern, repeated and aligned to the given disk offset
+func FillFixed(buf []byte, pattern []byte, offset int64) {
+	n := int64(len(pattern))
+	j := int(offset % n)
+	for i := range buf {
+		buf[i] = pattern[j]
+		j++
+		if j == len(pattern) {
+			j = 0
+		}
+	}
+}
+
+// A single write/read pass over the disk
+type Pass struct {
+	Pattern []byte // Fixed pattern or nil, for the seeded random chunks
+}
+
+// Classic badblocks -w patterns
+var CLASSIC_PASSES = []Pass{{[]byte{0xaa}}, {[]byte{0x55}}, {[]byte{0xff}}, {[]byte{0x00}}}
+
+func (p Pass) String() string {
+	if p.Pattern == nil {
+		return "random"
+	}
+	return "0x" + hex.EncodeToString(p.Pattern)
+}
+
+/* Parse a comma separated list of passes.
+ * Every entry is either "random" for the seeded random chunks, "classic" for the 0xaa/0x55/0xff/0x00 passes
+ * or a hex pattern, e.g. "0xaa" or "0xdeadbeef"
+ */
+func ParsePasses(str string) ([]Pass, error) {
+	passes := make([]Pass, 0)
+	for _, entry := range strings.Split(str, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch entry {
+		case "random":
+			passes = append(passes, Pass{})
+		case "classic":
+			passes = append(passes, CLASSIC_PASSES...)
+		default:
+			pattern, err := hex.DecodeString(strings.TrimPrefix(entry, "0x"))
+			if err != nil {
+				return passes, fmt.Errorf("invalid pattern '%s'", entry)
+			}
+			if len(pattern) == 0 {
+				return passes, fmt.Errorf("empty pattern")
+			}
+			passes = append(passes, Pass{pattern})
+		}
+	}
+	return passes, nil
+}
+
+// Format the given passes as comma separated list, as accepted by ParsePasses
+func FormatPasses(passes []Pass) string {
+	entries := make([]string, 0)
+	for _, pass := range passes {
+		entries = append(entries, pass.String())
+	}
+	return strings.Join(entries, ",")
+}
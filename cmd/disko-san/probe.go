@@ -0,0 +1,112 @@
+/* Quick fake-capacity probe for disko-san */
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+const PROBE_RANDOM = 64 // Number of randomly chosen probe offsets
+
+/* Get the probe offsets for a disk of the given size.
+ * The offsets are all multiples of the block size at powers of two, the last block of the disk and some randomly chosen
+ * offsets, in ascending order
+ */
+func probeOffsets(size int64, blockSize int64, seed int64) []int64 {
+	blocks := size / blockSize
+	if blocks <= 0 {
+		return nil
+	}
+	set := make(map[int64]bool, 0)
+	set[0] = true
+	for i := int64(1); i < blocks; i *= 2 {
+		set[i] = true
+	}
+	set[blocks-1] = true
+	state := uint64(seed)
+	for i := 0; i < PROBE_RANDOM; i++ {
+		set[int64(splitmix64(&state)%uint64(blocks))] = true
+	}
+
+	offsets := make([]int64, 0, len(set))
+	for block := range set {
+		offsets = append(offsets, block*blockSize)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets
+}
+
+/* Probe the real capacity of the disk.
+ * Writes uniquely tagged blocks at power-of-two and random offsets, then reads them all back. Disks with faked
+ * capacity wrap writes around, so blocks beyond the real capacity are lost or overwritten by later blocks.
+ * Returns the usable capacity, i.e. the end of the highest block which verified below the first failing block, and the
+ * offset of the first failing block as upper bound of the real capacity. Both are the disk size, if all blocks verify.
+ * Warning: This is a destructive function!
+ */
+func Probe(disk *Disk, params ChunkParams) (int64, int64, error) {
+	blockSize := int64(params.ChunkSize)
+	offsets := probeOffsets(disk.Size(), blockSize, params.Seed)
+	block := alignedBuffer(int(blockSize), DIRECT_ALIGNMENT)
+
+	fmt.Printf("Probing %d blocks of %d bytes\n", len(offsets), blockSize)
+	for _, pos := range offsets {
+		if !running {
+			return 0, 0, fmt.Errorf("interrupted")
+		}
+		CreateChunk(block, params, pos)
+		if _, err := disk.WriteAt(block, pos); err != nil {
+			return 0, 0, fmt.Errorf("write error at %d: %s", pos, err)
+		}
+	}
+	if err := disk.Sync(); err != nil {
+		return 0, 0, err
+	}
+	// Read back from the disk and not from the cache
+	if method, err := disk.InvalidateCache(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Cannot invalidate the cache (%s), reads might not hit the disk\n", err)
+	} else {
+		fmt.Printf("Cache invalidated (%s)\n", method)
+	}
+
+	// Read back. Every block which doesn't verify or holds the block of another offset limits the usable capacity
+	limit := disk.Size()
+	verified := make([]int64, 0, len(offsets))
+	for _, pos := range offsets {
+		if !running {
+			return 0, 0, fmt.Errorf("interrupted")
+		}
+		if n, err := disk.ReadAt(block, pos); err != nil {
+			fmt.Fprintf(os.Stderr, "Read error at %d: %s\n", pos, err)
+		} else if int64(n) != blockSize {
+			fmt.Fprintf(os.Stderr, "Short read at %d\n", pos)
+		} else if !VerifyChunk(block) {
+			fmt.Fprintf(os.Stderr, "Block at %d is corrupted\n", pos)
+		} else if header, ok := ParseChunkHeader(block); !ok || header.RunID != params.RunID {
+			fmt.Fprintf(os.Stderr, "Block at %d has not been written\n", pos)
+		} else if header.Offset != pos {
+			// The higher of both offsets is beyond the real capacity and aliased to the lower one
+			fmt.Fprintf(os.Stderr, "Block at %d holds the block for %d (aliased address)\n", pos, header.Offset)
+			if header.Offset > pos {
+				pos = header.Offset
+			}
+		} else {
+			verified = append(verified, pos)
+			continue
+		}
+		if pos < limit {
+			limit = pos
+		}
+	}
+	if limit == disk.Size() {
+		return limit, limit, nil
+	}
+	// Only the blocks below the first failing one are known to be usable
+	capacity := int64(0)
+	for _, pos := range verified {
+		if pos < limit && pos+blockSize > capacity {
+			capacity = pos + blockSize
+		}
+	}
+	return capacity, limit, nil
+}
@@ -6,14 +6,36 @@ import (
 	"io"
 	"os"
 	"strconv"
+	"strings"
 )
 
 // Progress struct for continuing
 type Progress struct {
-	filename string // Filename of the progress file
-	Size     int64  // Disk size
-	Pos      int64  // Disk position
-	State    int    // State of the process (0 = prepare, 1 = write, 2 = read, 3 = completed)
+	filename  string     // Filename of the progress file
+	Size      int64      // Disk size
+	Pos       int64      // Disk position
+	State     int        // State of the process (0 = prepare, 1 = write, 2 = read, 3 = completed, 4 = wipe)
+	Seed      int64      // Run seed for the chunk pattern (0 = no seed, progress files of older versions)
+	RunID     RunID      // Run ID stored in the chunk headers
+	Hash      HashType   // Chunk digest algorithm
+	Sectors   int        // Sector size for per-sector checksums (0 = disabled)
+	Passes    []Pass     // Write/read passes (nil = a single random pass)
+	Pass      int        // Current pass
+	ChunkSize int        // Chunk size of the run
+	Bad       []int64    // Disk positions of the bad chunks found so far
+	BadRanges [][2]int64 // Disk positions [start,end) of the bad bytes of the bad chunks
+	Recovered []int64    // Disk positions of the chunks, which read fine only after retries
+	Flush     string     // Cache invalidation method used before the read check of the current pass
+	Serial    string     // Serial number of the disk under test (empty, if unknown)
+	WWN       string     // World wide name of the disk under test (empty, if unknown)
+	Model     string     // Model of the disk under test (empty, if unknown)
+	Wipe      string     // Wipe mode after a successful test (empty = no wipe)
+	Start     int64      // First disk position of the tested range (0 = first testable chunk)
+	End       int64      // End of the tested range (0 = end of the disk)
+	Sample    float64    // Percentage of the chunks to test (0 = all chunks)
+	ReadOnly  bool       // Read-only surface scan instead of the destructive test
+	Preserve  bool       // Non-destructive read-write test, which preserves the original data
+	Slow      []int64    // Disk positions of the slow chunks of the read-only scan
 
 	f *os.File // Progress file handle or nil, if not present
 }
@@ -69,7 +91,94 @@ func (p *Progress) Read() error {
 	if p.State, err = strconv.Atoi(scanner.Text()); err != nil {
 		return err
 	}
-	return nil
+	// Optional key=value lines. Older progress files don't have them
+	p.Seed = 0
+	p.RunID = RunID{}
+	p.Hash = HASH_NONE
+	p.Sectors = 0
+	p.Passes = nil
+	p.Pass = 0
+	p.ChunkSize = DEFAULT_CHUNKSIZE // Older progress files have the fixed 4 MiB chunks
+	p.Bad = nil
+	p.BadRanges = nil
+	p.Recovered = nil
+	p.Flush = ""
+	p.Serial = ""
+	p.WWN = ""
+	p.Model = ""
+	p.Wipe = ""
+	p.Start = 0
+	p.End = 0
+	p.Sample = 0
+	p.ReadOnly = false
+	p.Preserve = false
+	p.Slow = nil
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid line: %s", line)
+		}
+		if err := p.parseValue(line[:i], line[i+1:]); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Parse a single key=value entry of the progress file
+func (p *Progress) parseValue(key string, value string) error {
+	var err error
+	switch key {
+	case "seed":
+		p.Seed, err = strconv.ParseInt(value, 10, 64)
+	case "runid":
+		p.RunID, err = ParseRunID(value)
+	case "hash":
+		p.Hash, err = ParseHashType(value)
+	case "sectorsize":
+		p.Sectors, err = strconv.Atoi(value)
+	case "passes":
+		p.Passes, err = ParsePasses(value)
+	case "pass":
+		p.Pass, err = strconv.Atoi(value)
+	case "chunksize":
+		p.ChunkSize, err = strconv.Atoi(value)
+	case "bad":
+		p.Bad, err = parsePositions(value)
+	case "badranges":
+		p.BadRanges, err = parseRanges(value)
+	case "recovered":
+		p.Recovered, err = parsePositions(value)
+	case "flush":
+		p.Flush = value
+	case "serial":
+		p.Serial = value
+	case "wwn":
+		p.WWN = value
+	case "model":
+		p.Model = value
+	case "wipe":
+		p.Wipe, err = ParseWipeMode(value)
+	case "start":
+		p.Start, err = strconv.ParseInt(value, 10, 64)
+	case "end":
+		p.End, err = strconv.ParseInt(value, 10, 64)
+	case "sample":
+		p.Sample, err = strconv.ParseFloat(value, 64)
+	case "readonly":
+		p.ReadOnly, err = strconv.ParseBool(value)
+	case "nondestructive":
+		p.Preserve, err = strconv.ParseBool(value)
+	case "slow":
+		p.Slow, err = parsePositions(value)
+	default:
+		return fmt.Errorf("unknown key '%s'", key)
+	}
+	return err
 }
 
 func (p *Progress) Write() error {
@@ -83,6 +192,63 @@ func (p *Progress) Write() error {
 	}
 
 	str := fmt.Sprintf("%d\n%d\n%d", p.Size, p.Pos, p.State)
+	if p.Seed != 0 {
+		str += fmt.Sprintf("\nseed=%d\nrunid=%s", p.Seed, p.RunID)
+	}
+	if p.Hash != HASH_NONE {
+		str += fmt.Sprintf("\nhash=%s", p.Hash)
+	}
+	if p.Sectors != 0 {
+		str += fmt.Sprintf("\nsectorsize=%d", p.Sectors)
+	}
+	if p.ChunkSize != 0 {
+		str += fmt.Sprintf("\nchunksize=%d", p.ChunkSize)
+	}
+	if p.Start != 0 {
+		str += fmt.Sprintf("\nstart=%d", p.Start)
+	}
+	if p.End != 0 {
+		str += fmt.Sprintf("\nend=%d", p.End)
+	}
+	if p.Sample != 0 {
+		str += fmt.Sprintf("\nsample=%s", strconv.FormatFloat(p.Sample, 'g', -1, 64))
+	}
+	if p.ReadOnly {
+		str += "\nreadonly=true"
+	}
+	if p.Preserve {
+		str += "\nnondestructive=true"
+	}
+	if len(p.Bad) > 0 {
+		str += fmt.Sprintf("\nbad=%s", formatPositions(p.Bad))
+	}
+	if len(p.BadRanges) > 0 {
+		str += fmt.Sprintf("\nbadranges=%s", formatRanges(p.BadRanges))
+	}
+	if len(p.Slow) > 0 {
+		str += fmt.Sprintf("\nslow=%s", formatPositions(p.Slow))
+	}
+	if p.Serial != "" {
+		str += fmt.Sprintf("\nserial=%s", p.Serial)
+	}
+	if p.WWN != "" {
+		str += fmt.Sprintf("\nwwn=%s", p.WWN)
+	}
+	if p.Model != "" {
+		str += fmt.Sprintf("\nmodel=%s", p.Model)
+	}
+	if p.Wipe != "" {
+		str += fmt.Sprintf("\nwipe=%s", p.Wipe)
+	}
+	if p.Flush != "" {
+		str += fmt.Sprintf("\nflush=%s", p.Flush)
+	}
+	if len(p.Recovered) > 0 {
+		str += fmt.Sprintf("\nrecovered=%s", formatPositions(p.Recovered))
+	}
+	if len(p.Passes) > 0 {
+		str += fmt.Sprintf("\npasses=%s\npass=%d", FormatPasses(p.Passes), p.Pass)
+	}
 	if n, err := p.f.Write([]byte(str)); err != nil {
 		return err
 	} else {
@@ -94,6 +260,234 @@ func (p *Progress) Write() error {
 	}
 }
 
+/* Initialize the parameters of a new run from the given configuration. A seed of 0 picks a random seed and run ID,
+ * a given seed also determines the run ID to replay the run
+ */
+func (p *Progress) InitRun(c *conf) {
+	p.Seed = c.seed
+	if p.Seed == 0 {
+		p.Seed = NewSeed()
+		p.RunID = NewRunID()
+	} else {
+		p.RunID = SeedRunID(p.Seed)
+	}
+	p.Hash = c.hash
+	if p.Hash == HASH_NONE {
+		p.Hash = DEFAULT_HASH
+	}
+	p.Sectors = c.sectors
+	p.Passes = c.passes
+	p.Wipe = c.wipe
+	p.Sample = c.sample
+	p.ReadOnly = c.readOnly
+	p.Preserve = c.preserve
+	p.Pass = 0
+	p.ChunkSize = c.chunkSize
+	if p.ChunkSize == 0 {
+		p.ChunkSize = DEFAULT_CHUNKSIZE
+	}
+}
+
+// Number of write/read passes of the run
+func (p *Progress) PassCount() int {
+	if len(p.Passes) == 0 {
+		return 1
+	}
+	return len(p.Passes)
+}
+
+// Get the current write/read pass
+func (p *Progress) CurrentPass() Pass {
+	if p.Pass < 0 || p.Pass >= len(p.Passes) {
+		return Pass{}
+	}
+	return p.Passes[p.Pass]
+}
+
+// Get the chunk parameters of the current pass
+func (p *Progress) ChunkParams() ChunkParams {
+	return p.PassParams(p.Pass)
+}
+
+// Get the chunk parameters of the given pass
+func (p *Progress) PassParams(pass int) ChunkParams {
+	var pattern []byte
+	if pass >= 0 && pass < len(p.Passes) {
+		pattern = p.Passes[pass].Pattern
+	}
+	return ChunkParams{Seed: p.Seed, RunID: p.RunID, Hash: p.Hash, SectorSize: p.Sectors, Pattern: pattern, ChunkSize: p.ChunkSize}
+}
+
+// Check if the run overwrites the data on the disk, i.e. it is neither a read-only scan nor a non-destructive test
+func (p *Progress) Destructive() bool {
+	return !p.ReadOnly && !p.Preserve
+}
+
+// Get the name of the test mode
+func (p *Progress) Mode() string {
+	if p.ReadOnly {
+		return "read-only scan"
+	} else if p.Preserve {
+		return "non-destructive test"
+	}
+	return "destructive test"
+}
+
+/* First disk position, which may be tested. The first chunk holds the run header and is never tested, except by
+ * the read-only scan and the non-destructive test, which don't write a header
+ */
+func (p *Progress) firstPosition() int64 {
+	if !p.Destructive() {
+		return 0
+	}
+	return int64(p.ChunkSize)
+}
+
+// First disk position of the tested range
+func (p *Progress) RangeStart() int64 {
+	if p.Start < p.firstPosition() {
+		return p.firstPosition()
+	}
+	return p.Start
+}
+
+// End of the tested range
+func (p *Progress) RangeEnd() int64 {
+	if p.End == 0 || p.End > p.Size {
+		return p.Size
+	}
+	return p.End
+}
+
+// Check if the run only tests a part of the disk
+func (p *Progress) IsRange() bool {
+	return p.Start != 0 || p.End != 0
+}
+
+/* Check the given range for the run: Both ends must be multiples of the logical sector size, as direct I/O cannot
+ * access parts of a sector, and the range must not start within the first chunk, which holds the run header.
+ * The first and the last chunk of the range are clipped to it, so nothing outside of it is touched.
+ * Returns the values as stored in the progress file, i.e. 0 for the beginning or the end of the disk
+ */
+func (p *Progress) CheckRange(start int64, end int64, lbaSize int) (int64, int64, error) {
+	if start < 0 || end < 0 {
+		return 0, 0, fmt.Errorf("negative position")
+	}
+	if start%int64(lbaSize) != 0 || end%int64(lbaSize) != 0 {
+		return 0, 0, fmt.Errorf("the range %d-%d is not aligned to the logical sector size %d", start, end, lbaSize)
+	}
+	if start >= p.Size {
+		return 0, 0, fmt.Errorf("start %d is behind the end of the disk (%d bytes)", start, p.Size)
+	}
+	if end > p.Size {
+		return 0, 0, fmt.Errorf("end %d is behind the end of the disk (%d bytes)", end, p.Size)
+	}
+	if end != 0 && end <= start {
+		return 0, 0, fmt.Errorf("end %d is not behind the start %d", end, start)
+	}
+	if start > 0 && start < p.firstPosition() {
+		return 0, 0, fmt.Errorf("start %d is within the first chunk (%d bytes), which holds the run header", start, p.firstPosition())
+	}
+	if end != 0 && end <= p.firstPosition() {
+		return 0, 0, fmt.Errorf("the range is within the first chunk, which holds the run header")
+	}
+	if end == p.Size {
+		end = 0
+	}
+	return start, end, nil
+}
+
+// Count the chunks, which overlap the given positions
+func (p *Progress) Chunks(start int64, end int64) int64 {
+	if end <= start {
+		return 0
+	}
+	return (end-1)/int64(p.ChunkSize) - start/int64(p.ChunkSize) + 1
+}
+
+/* Get the size of the chunk at the given disk position. Chunks are aligned to the chunk size, the first and the
+ * last chunk of the tested range might be smaller
+ */
+func (p *Progress) ChunkSizeAt(pos int64) int64 {
+	chunkSize := int64(p.ChunkSize)
+	size := chunkSize - pos%chunkSize
+	if end := p.RangeEnd(); pos+size > end {
+		size = end - pos
+	}
+	return size
+}
+
+func (p *Progress) Percent() float32 {
+	start, end := p.RangeStart(), p.RangeEnd()
+	if p.Pos <= start || end <= start {
+		return 0
+	}
+	return 100.0 * (float32(p.Pos-start) / float32(end-start))
+}
+
+// Parse a comma separated list of disk positions
+func parsePositions(str string) ([]int64, error) {
+	list := make([]int64, 0)
+	for _, entry := range strings.Split(str, ",") {
+		pos, err := strconv.ParseInt(strings.TrimSpace(entry), 10, 64)
+		if err != nil {
+			return list, err
+		}
+		list = insertPosition(list, pos)
+	}
+	return list, nil
+}
+
+// Format the given disk positions as comma separated list
+func formatPositions(list []int64) string {
+	entries := make([]string, 0, len(list))
+	for _, pos := range list {
+		entries = append(entries, strconv.FormatInt(pos, 10))
+	}
+	return strings.Join(entries, ",")
+}
+
+// Parse a comma separated list of disk position ranges start-end
+func parseRanges(str string) ([][2]int64, error) {
+	list := make([][2]int64, 0)
+	for _, entry := range strings.Split(str, ",") {
+		fields := strings.SplitN(strings.TrimSpace(entry), "-", 2)
+		if len(fields) != 2 {
+			return list, fmt.Errorf("invalid range '%s'", entry)
+		}
+		start, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return list, err
+		}
+		end, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return list, err
+		}
+		if end <= start {
+			return list, fmt.Errorf("invalid range '%s'", entry)
+		}
+		list = insertRange(list, [2]int64{start, end})
+	}
+	return list, nil
+}
+
+// Format the given disk position ranges as comma separated list of start-end
+func formatRanges(list [][2]int64) string {
+	entries := make([]string, 0, len(list))
+	for _, r := range list {
+		entries = append(entries, fmt.Sprintf("%d-%d", r[0], r[1]))
+	}
+	return strings.Join(entries, ",")
+}
+
+// Record the chunk of the given error as bad, together with its bad bytes
+func (p *Progress) AddBad(cerr *ChunkError) {
+	p.Bad = insertPosition(p.Bad, cerr.Pos)
+	for _, r := range cerr.BadRanges() {
+		p.BadRanges = insertRange(p.BadRanges, r)
+	}
+}
+
 func (p *Progress) WriteIfOpen() error {
 	if p.f == nil {
 		return nil
@@ -107,3 +501,24 @@ func (p *Progress) Sync() error {
 	}
 	return p.f.Sync()
 }
+
+// Bind the run to the given disk identity
+func (p *Progress) BindDisk(id DiskIdentity) {
+	p.Serial = id.Serial
+	p.WWN = id.WWN
+	p.Model = id.Model
+}
+
+// Check if the given disk identity is the one of the run. Values not recorded (e.g. by older versions) are not checked
+func (p *Progress) CheckDisk(id DiskIdentity) error {
+	if p.Serial != "" && p.Serial != id.Serial {
+		return fmt.Errorf("The disk has the serial number '%s', but the progress file says it should be '%s'", id.Serial, p.Serial)
+	}
+	if p.WWN != "" && p.WWN != id.WWN {
+		return fmt.Errorf("The disk has the WWN '%s', but the progress file says it should be '%s'", id.WWN, p.WWN)
+	}
+	if p.Model != "" && p.Model != id.Model {
+		return fmt.Errorf("The disk model is '%s', but the progress file says it should be '%s'", id.Model, p.Model)
+	}
+	return nil
+}
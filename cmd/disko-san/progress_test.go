@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testChunkSize = 4 * 1024 * 1024
+
+// 64 MiB disk with 4 MiB chunks
+func testProgress() *Progress {
+	return &Progress{Size: 16 * testChunkSize, ChunkSize: testChunkSize}
+}
+
+// Ranges against a 64 MiB disk with 4 MiB chunks and 512 byte sectors, in the destructive and the read-only mode
+func TestCheckRange(t *testing.T) {
+	const M = 1024 * 1024
+	tests := []struct {
+		name     string
+		readOnly bool
+		start    int64
+		end      int64
+		valid    bool
+		expected [2]int64 // start and end as stored in the progress file
+	}{
+		{"whole disk", false, 0, 0, true, [2]int64{0, 0}},
+		{"end of the disk", false, 0, 64 * M, true, [2]int64{0, 0}},
+		{"aligned", false, 8 * M, 16 * M, true, [2]int64{8 * M, 16 * M}},
+		{"within a chunk", false, 9 * M, 10 * M, true, [2]int64{9 * M, 10 * M}},
+		{"sector aligned", false, 5*M + 512, 14*M - 512, true, [2]int64{5*M + 512, 14*M - 512}},
+		{"second chunk", false, 4 * M, 0, true, [2]int64{4 * M, 0}},
+		{"unaligned start", false, 5*M + 100, 0, false, [2]int64{}},
+		{"unaligned end", false, 0, 14*M + 100, false, [2]int64{}},
+		{"negative", false, -512, 0, false, [2]int64{}},
+		{"start behind the disk", false, 64 * M, 0, false, [2]int64{}},
+		{"end behind the disk", false, 0, 65 * M, false, [2]int64{}},
+		{"empty", false, 8 * M, 8 * M, false, [2]int64{}},
+		{"reversed", false, 12 * M, 8 * M, false, [2]int64{}},
+		{"start in the header chunk", false, 1 * M, 0, false, [2]int64{}},
+		{"end in the header chunk", false, 0, 2 * M, false, [2]int64{}},
+		{"end at the header chunk", false, 0, 4 * M, false, [2]int64{}},
+		{"read-only first chunk", true, 1 * M, 2 * M, true, [2]int64{1 * M, 2 * M}},
+	}
+	for _, test := range tests {
+		progress := testProgress()
+		progress.ReadOnly = test.readOnly
+		start, end, err := progress.CheckRange(test.start, test.end, 512)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: range %d-%d accepted", test.name, test.start, test.end)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if [2]int64{start, end} != test.expected {
+			t.Errorf("%s: range %d-%d, expected %d-%d", test.name, start, end, test.expected[0], test.expected[1])
+		}
+	}
+}
+
+// Chunks are aligned to the chunk size and clipped to the tested range
+func TestChunkSizeAt(t *testing.T) {
+	const M = 1024 * 1024
+	tests := []struct {
+		name   string
+		start  int64
+		end    int64
+		pos    int64
+		size   int64
+		chunks int64 // chunks of the whole range
+	}{
+		{"whole disk", 0, 0, 8 * M, 4 * M, 15},
+		{"last chunk", 0, 0, 60 * M, 4 * M, 15},
+		{"clipped start", 5 * M, 14 * M, 5 * M, 3 * M, 3},
+		{"middle", 5 * M, 14 * M, 8 * M, 4 * M, 3},
+		{"clipped end", 5 * M, 14 * M, 12 * M, 2 * M, 3},
+		{"within a chunk", 9 * M, 10 * M, 9 * M, 1 * M, 1},
+		{"aligned", 8 * M, 16 * M, 12 * M, 4 * M, 2},
+	}
+	for _, test := range tests {
+		progress := testProgress()
+		progress.Start, progress.End = test.start, test.end
+		if size := progress.ChunkSizeAt(test.pos); size != test.size {
+			t.Errorf("%s: chunk size %d at %d, expected %d", test.name, size, test.pos, test.size)
+		}
+		if chunks := progress.Chunks(progress.RangeStart(), progress.RangeEnd()); chunks != test.chunks {
+			t.Errorf("%s: %d chunks, expected %d", test.name, chunks, test.chunks)
+		}
+	}
+}
+
+// Bad byte ranges as stored in the progress file
+func TestParseRanges(t *testing.T) {
+	tests := []struct {
+		str      string
+		valid    bool
+		expected [][2]int64
+	}{
+		{"0-512", true, [][2]int64{{0, 512}}},
+		{"1024-2048, 0-512", true, [][2]int64{{0, 512}, {1024, 2048}}},
+		{"0-512,512-1024", true, [][2]int64{{0, 1024}}},
+		{"0-1024,256-512", true, [][2]int64{{0, 1024}}},
+		{"512", false, nil},
+		{"512-512", false, nil},
+		{"1024-512", false, nil},
+		{"a-512", false, nil},
+		{"0-", false, nil},
+		{"-512-1024", false, nil},
+	}
+	for _, test := range tests {
+		list, err := parseRanges(test.str)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("'%s': accepted as %v", test.str, list)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': %s", test.str, err)
+			continue
+		}
+		if !reflect.DeepEqual(list, test.expected) {
+			t.Errorf("'%s': parsed as %v, expected %v", test.str, list, test.expected)
+		}
+		if reparsed, err := parseRanges(formatRanges(list)); err != nil || !reflect.DeepEqual(reparsed, list) {
+			t.Errorf("'%s': formatted as '%s', which does not parse back", test.str, formatRanges(list))
+		}
+	}
+}
@@ -0,0 +1,179 @@
+/* Parallel I/O engine for disko-san */
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const QUEUE_MAX = 64             // Maximum queue depth. Every slot holds its own chunk buffers
+const QUEUE_BASELINE = 16        // Minimum number of chunks at the beginning of every phase, which run at queue depth 1 as baseline
+const QUEUE_BASELINE_PERCENT = 1 // Percentage of the chunks of a phase, which run at queue depth 1 as baseline
+
+// Chunk operation in the I/O queue
+type ChunkIO struct {
+	Pos      int64         // disk position of the chunk
+	Buf      []byte        // chunk to write or read, limited to the size of the chunk
+	Expected []byte        // expected chunk of the read check
+	N        int           // number of bytes written or read
+	Err      error         // I/O error
+	Cerr     *ChunkError   // result of the chunk verification, if done by the operation
+	Runtime  time.Duration // latency of the I/O
+	Interval time.Duration // time since the previous chunk completed
+	done     chan bool
+}
+
+// Throughput measured at a queue depth
+type Rate struct {
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// Bytes per second, or 0 if nothing has been measured
+func (r Rate) PerSecond() float32 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float32(float64(r.Bytes) / r.Elapsed.Seconds())
+}
+
+// Throughput of a phase at queue depth 1 (baseline) and at the configured queue depth
+type QueueStats struct {
+	Depth    int
+	Baseline Rate
+	Queued   Rate
+}
+
+/* Queue of chunk operations, which run in parallel up to the queue depth, but complete in the order they have been
+ * submitted. The progress therefore only advances over chunks which are done and always is a safe resume position.
+ * With a queue depth above 1, the first QUEUE_BASELINE_PERCENT of the chunks (at least QUEUE_BASELINE chunks) run one
+ * at a time as throughput baseline
+ */
+type IOQueue struct {
+	depth     int
+	slots     []ChunkIO
+	head      int       // oldest slot in flight
+	pending   int       // number of slots in flight
+	baseline  int       // number of chunks, which run at queue depth 1
+	submitted int       // number of submitted chunks
+	completed int       // number of completed chunks
+	last      time.Time // completion time of the previous chunk
+	stats     *QueueStats
+}
+
+/* Create a queue of the given depth for chunks of the given size, which accounts its throughput to the given stats.
+ * The number of chunks of the phase determines the size of the baseline
+ */
+func NewIOQueue(depth int, chunkSize int, chunks int64, stats *QueueStats) *IOQueue {
+	if depth < 1 {
+		depth = 1
+	}
+	q := &IOQueue{depth: depth, slots: make([]ChunkIO, depth), stats: stats}
+	q.baseline = int(chunks * QUEUE_BASELINE_PERCENT / 100)
+	if q.baseline < QUEUE_BASELINE {
+		q.baseline = QUEUE_BASELINE
+	}
+	for i := range q.slots {
+		q.slots[i].Buf = alignedBuffer(chunkSize, DIRECT_ALIGNMENT)
+		q.slots[i].Expected = make([]byte, chunkSize)
+		q.slots[i].done = make(chan bool, 1)
+	}
+	stats.Depth = depth
+	return q
+}
+
+// Check if no further chunk can be submitted before the oldest one completes
+func (q *IOQueue) Full() bool {
+	if q.submitted < q.baseline {
+		return q.pending >= 1
+	}
+	return q.pending >= q.depth
+}
+
+// Number of chunks in flight
+func (q *IOQueue) Pending() int {
+	return q.pending
+}
+
+/* Get the free slot for the chunk of the given size at the given position. The queue must not be full.
+ * The buffers are limited to the chunk size and need to be filled before submitting the chunk
+ */
+func (q *IOQueue) Next(pos int64, size int64) *ChunkIO {
+	c := &q.slots[(q.head+q.pending)%q.depth]
+	c.Pos = pos
+	c.Buf = c.Buf[:size]
+	c.Expected = c.Expected[:size]
+	c.N, c.Err, c.Cerr, c.Runtime, c.Interval = 0, nil, nil, 0, 0
+	return c
+}
+
+// Run the given operation on the chunk in the background
+func (q *IOQueue) Submit(c *ChunkIO, op func(c *ChunkIO)) {
+	if q.last.IsZero() {
+		q.last = time.Now()
+	}
+	q.pending++
+	q.submitted++
+	go func() {
+		op(c)
+		c.done <- true
+	}()
+}
+
+/* Wait for the oldest chunk in flight and account its throughput.
+ * The returned chunk stays valid until the next call of Next
+ */
+func (q *IOQueue) Wait() *ChunkIO {
+	c := &q.slots[q.head]
+	<-c.done
+	q.head = (q.head + 1) % q.depth
+	q.pending--
+
+	now := time.Now()
+	c.Interval = now.Sub(q.last)
+	q.last = now
+	rate := &q.stats.Queued
+	if q.depth == 1 || q.completed < q.baseline {
+		rate = &q.stats.Baseline
+	}
+	rate.Bytes += int64(len(c.Buf))
+	rate.Elapsed += c.Interval
+	q.completed++
+	return c
+}
+
+// Wait for all chunks in flight, e.g. before returning early
+func (q *IOQueue) Drain() {
+	for q.pending > 0 {
+		q.Wait()
+	}
+}
+
+/* Print the throughput at queue depth 1 and at the configured queue depth side by side.
+ * Queue depth 1 is measured on the baseline at the beginning of every phase only, so its size is printed as well
+ */
+func PrintThroughputReport(write QueueStats, read QueueStats) {
+	depth := write.Depth
+	if read.Depth > depth {
+		depth = read.Depth
+	}
+	if depth <= 1 {
+		return
+	}
+	fmt.Printf("Throughput %16s %16s\n", "QD1", fmt.Sprintf("QD%d", depth))
+	for _, phase := range []struct {
+		name  string
+		stats QueueStats
+	}{{"write", write}, {"read", read}} {
+		if phase.stats.Baseline.Bytes == 0 {
+			continue
+		}
+		baseline, queued := phase.stats.Baseline.PerSecond(), phase.stats.Queued.PerSecond()
+		if queued == 0 {
+			fmt.Printf("  %-8s %14s/s %16s", phase.name, gibistr(baseline), "n/a")
+		} else {
+			fmt.Printf("  %-8s %14s/s %14s/s (%.2fx)", phase.name, gibistr(baseline), gibistr(queued), queued/baseline)
+		}
+		fmt.Printf(", QD1 measured on %s\n", gibistr(float32(phase.stats.Baseline.Bytes)))
+	}
+}
@@ -0,0 +1,164 @@
+/* Scan results and error budget for disko-san */
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const ERROR_RATE_MIN_CHUNKS = 100 // Minimum number of checked chunks before the error rate is considered
+
+// Abort policy for continue-on-error scans
+type ErrorBudget struct {
+	Continue  bool    // Continue the scan after bad chunks
+	MaxErrors int     // Abort after this many bad chunks (0 = unlimited)
+	MaxRate   float64 // Abort if the percentage of bad chunks exceeds this value (0 = unlimited)
+}
+
+// Check if the given number of bad chunks out of the checked chunks exceeds the budget
+func (b ErrorBudget) Exceeded(bad int, checked int64) bool {
+	if !b.Continue {
+		return bad > 0
+	}
+	if b.MaxErrors > 0 && bad >= b.MaxErrors {
+		return true
+	}
+	if b.MaxRate > 0 && checked >= ERROR_RATE_MIN_CHUNKS {
+		return 100.0*float64(bad)/float64(checked) > b.MaxRate
+	}
+	return false
+}
+
+// Re-read policy for failed chunks
+type RetryPolicy struct {
+	Retries   int  // Number of re-reads of a failed chunk (0 = no retries)
+	DropCache bool // Drop the chunk from the page cache before every re-read
+	Direct    bool // Re-read with direct I/O, bypassing the page cache
+}
+
+// Insert the given position into the sorted list, if not yet present
+func insertPosition(list []int64, pos int64) []int64 {
+	i := sort.Search(len(list), func(i int) bool { return list[i] >= pos })
+	if i < len(list) && list[i] == pos {
+		return list
+	}
+	list = append(list, 0)
+	copy(list[i+1:], list[i:])
+	list[i] = pos
+	return list
+}
+
+// Insert the range [start,end) into the sorted list of disjoint ranges, merging overlapping and adjacent ranges
+func insertRange(list [][2]int64, r [2]int64) [][2]int64 {
+	i := sort.Search(len(list), func(i int) bool { return list[i][1] >= r[0] })
+	j := i
+	for ; j < len(list) && list[j][0] <= r[1]; j++ {
+		if list[j][0] < r[0] {
+			r[0] = list[j][0]
+		}
+		if list[j][1] > r[1] {
+			r[1] = list[j][1]
+		}
+	}
+	return append(list[:i], append([][2]int64{r}, list[j:]...)...)
+}
+
+/* Print the list of all bad chunks found so far and of the chunks, which were recovered after retries.
+ * Recovered chunks are no failures, but early signs of pending sectors
+ */
+func PrintDamageReport(progress *Progress, lbaSize int) {
+	printChunkList("bad chunks", progress.Bad, progress, lbaSize)
+	printChunkList("chunks recovered after retries", progress.Recovered, progress, lbaSize)
+}
+
+// Print how the cached data was invalidated before the read check
+func PrintFlushReport(progress *Progress) {
+	if progress.Flush != "" {
+		fmt.Printf("Cache invalidation before the read check: %s\n", progress.Flush)
+	}
+}
+
+func printChunkList(title string, list []int64, progress *Progress, lbaSize int) {
+	if len(list) == 0 {
+		return
+	}
+	chunkSize := int64(progress.ChunkSize)
+	fmt.Printf("%d %s:\n", len(list), title)
+	for _, pos := range list {
+		end := pos + progress.ChunkSizeAt(pos)
+		fmt.Printf("  chunk %d: disk position %d - %d (LBA %d - %d)\n", pos/chunkSize, pos, end, pos/int64(lbaSize), (end-1)/int64(lbaSize))
+	}
+}
+
+// Print the slow regions found by the read-only scan. Adjacent slow chunks are merged into a single region
+func PrintSlowReport(progress *Progress, lbaSize int) {
+	if len(progress.Slow) == 0 {
+		return
+	}
+	type region struct{ start, end int64 }
+	regions := make([]region, 0)
+	for _, pos := range progress.Slow {
+		end := pos + progress.ChunkSizeAt(pos)
+		if n := len(regions); n > 0 && regions[n-1].end == pos {
+			regions[n-1].end = end
+		} else {
+			regions = append(regions, region{pos, end})
+		}
+	}
+	fmt.Printf("%d slow regions (%d slow chunks):\n", len(regions), len(progress.Slow))
+	for _, r := range regions {
+		fmt.Printf("  disk position %d - %d (%s, LBA %d - %d)\n", r.start, r.end, gibistr(float32(r.end-r.start)), r.start/int64(lbaSize), (r.end-1)/int64(lbaSize))
+	}
+}
+
+/* Get the block numbers of all blocks of the given size, which overlap the bad bytes of a bad chunk.
+ * Bad chunks without recorded bad bytes, e.g. of progress files of older versions, are taken as a whole.
+ * This is the list `badblocks -o` produces, as read by `mke2fs -l` and `e2fsck -l`
+ */
+func BadBlocks(progress *Progress, blockSize int64) []int64 {
+	ranges := append([][2]int64{}, progress.BadRanges...)
+	for _, pos := range progress.Bad {
+		end := pos + progress.ChunkSizeAt(pos)
+		i := sort.Search(len(ranges), func(i int) bool { return ranges[i][1] > pos })
+		if i == len(ranges) || ranges[i][0] >= end {
+			ranges = insertRange(ranges, [2]int64{pos, end})
+		}
+	}
+
+	blocks := make([]int64, 0)
+	last := int64(-1)
+	for _, r := range ranges {
+		end := r[1]
+		if end > progress.Size {
+			end = progress.Size
+		}
+		for block := r[0] / blockSize; block <= (end-1)/blockSize; block++ {
+			if block > last { // Ranges are sorted, but might share a block
+				blocks = append(blocks, block)
+				last = block
+			}
+		}
+	}
+	return blocks
+}
+
+// Write the bad blocks list in the `badblocks -o` format: one block number per line
+func ExportBadBlocks(filename string, progress *Progress, blockSize int64) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, block := range BadBlocks(progress, blockSize) {
+		if _, err := fmt.Fprintf(w, "%d\n", block); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Ranges are kept sorted and disjoint, overlapping and adjacent ranges are merged
+func TestInsertRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		list     [][2]int64
+		r        [2]int64
+		expected [][2]int64
+	}{
+		{"empty", nil, [2]int64{10, 20}, [][2]int64{{10, 20}}},
+		{"before", [][2]int64{{30, 40}}, [2]int64{10, 20}, [][2]int64{{10, 20}, {30, 40}}},
+		{"behind", [][2]int64{{10, 20}}, [2]int64{30, 40}, [][2]int64{{10, 20}, {30, 40}}},
+		{"between", [][2]int64{{0, 5}, {30, 40}}, [2]int64{10, 20}, [][2]int64{{0, 5}, {10, 20}, {30, 40}}},
+		{"adjacent before", [][2]int64{{20, 30}}, [2]int64{10, 20}, [][2]int64{{10, 30}}},
+		{"adjacent behind", [][2]int64{{10, 20}}, [2]int64{20, 30}, [][2]int64{{10, 30}}},
+		{"overlapping", [][2]int64{{10, 20}}, [2]int64{15, 25}, [][2]int64{{10, 25}}},
+		{"contained", [][2]int64{{10, 40}}, [2]int64{15, 25}, [][2]int64{{10, 40}}},
+		{"duplicate", [][2]int64{{10, 20}}, [2]int64{10, 20}, [][2]int64{{10, 20}}},
+		{"spanning", [][2]int64{{0, 5}, {10, 20}, {30, 40}, {50, 60}}, [2]int64{15, 35}, [][2]int64{{0, 5}, {10, 40}, {50, 60}}},
+		{"covering", [][2]int64{{10, 20}, {30, 40}}, [2]int64{0, 50}, [][2]int64{{0, 50}}},
+	}
+	for _, test := range tests {
+		list := insertRange(append([][2]int64{}, test.list...), test.r)
+		if !reflect.DeepEqual(list, test.expected) {
+			t.Errorf("%s: %v, expected %v", test.name, list, test.expected)
+		}
+	}
+}
+
+// Block numbers of the bad bytes on a 64 MiB disk with 4 MiB chunks
+func TestBadBlocks(t *testing.T) {
+	const M = 1024 * 1024
+	tests := []struct {
+		name      string
+		start     int64
+		end       int64
+		bad       []int64
+		ranges    [][2]int64
+		blockSize int64
+		expected  []int64
+	}{
+		{"none", 0, 0, nil, nil, 4096, []int64{}},
+		{"single sector", 0, 0, []int64{8 * M}, [][2]int64{{8*M + 512, 8*M + 1024}}, 4096, []int64{2048}},
+		{"across blocks", 0, 0, []int64{8 * M}, [][2]int64{{8*M + 4000, 8*M + 4200}}, 4096, []int64{2048, 2049}},
+		{"shared block", 0, 0, []int64{8 * M}, [][2]int64{{8 * M, 8*M + 512}, {8*M + 1024, 8*M + 1536}}, 4096, []int64{2048}},
+		{"1k blocks", 0, 0, []int64{8 * M}, [][2]int64{{8*M + 512, 8*M + 1536}}, 1024, []int64{8192, 8193}},
+		{"whole chunk", 0, 0, []int64{60 * M}, nil, 1024 * 1024, []int64{60, 61, 62, 63}},
+		{"clipped chunk", 5 * M, 14 * M, []int64{12 * M}, nil, 1024 * 1024, []int64{12, 13}},
+		{"chunk and ranges", 0, 0, []int64{4 * M, 8 * M}, [][2]int64{{8 * M, 8*M + 512}}, 1024 * 1024, []int64{4, 5, 6, 7, 8}},
+	}
+	for _, test := range tests {
+		progress := testProgress()
+		progress.Start, progress.End = test.start, test.end
+		progress.Bad, progress.BadRanges = test.bad, test.ranges
+		if blocks := BadBlocks(progress, test.blockSize); !reflect.DeepEqual(blocks, test.expected) {
+			t.Errorf("%s: %v, expected %v", test.name, blocks, test.expected)
+		}
+	}
+}
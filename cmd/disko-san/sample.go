@@ -0,0 +1,80 @@
+/* Statistical sampling of chunks for disko-san */
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const SAMPLE_CONFIDENCE = 0.95 // Confidence level of the sampling report
+
+/* Check if the chunk at the given position is part of the sample. Without sampling every chunk is.
+ * Every chunk is chosen independently with the sample probability, derived from the run seed and the chunk index.
+ * This spreads the sample across the whole surface and always picks the same chunks for a run, also on resume
+ */
+func (p *Progress) Sampled(pos int64) bool {
+	if p.Sample <= 0 || p.Sample >= 100 {
+		return true
+	}
+	mix := uint64(pos / int64(p.ChunkSize))
+	state := ^uint64(p.Seed) ^ splitmix64(&mix) // Not the state of the chunk pattern at the same position
+	value := float64(splitmix64(&state)>>11) / (1 << 53)
+	return value < p.Sample/100.0
+}
+
+// Get the position of the next chunk of the sample at or behind the given position, or the end of the tested range
+func (p *Progress) NextSample(pos int64) int64 {
+	end := p.RangeEnd()
+	for pos < end && !p.Sampled(pos) {
+		pos += int64(p.ChunkSize) - pos%int64(p.ChunkSize) // The first chunk of a range might not be aligned
+	}
+	if pos > end {
+		return end
+	}
+	return pos
+}
+
+// Count the chunks of the sample between the given positions
+func (p *Progress) SampledChunks(start int64, end int64) int64 {
+	if p.Sample <= 0 || p.Sample >= 100 {
+		return p.Chunks(start, end)
+	}
+	count := int64(0)
+	for pos := start; pos < end; pos += int64(p.ChunkSize) - pos%int64(p.ChunkSize) {
+		if p.Sampled(pos) {
+			count++
+		}
+	}
+	return count
+}
+
+/* Print what the sample tells about the untested chunks.
+ * Without bad chunks in the sample, the fraction of bad chunks is below 1-(1-c)^(1/n) with confidence c for n tested
+ * chunks, assuming the bad chunks are spread uniformly. A contiguous defect is hit with confidence c if it spans at
+ * least log(1-c)/log(1-rate) chunks
+ */
+func PrintSampleReport(progress *Progress) {
+	if progress.Sample <= 0 || progress.Sample >= 100 {
+		return
+	}
+	chunkSize := int64(progress.ChunkSize)
+	start, end := progress.RangeStart(), progress.RangeEnd()
+	total := progress.Chunks(start, end)
+	tested := progress.SampledChunks(start, end)
+	untested := total - tested
+	bad := int64(len(progress.Bad))
+	confidence := 100.0 * SAMPLE_CONFIDENCE
+	fmt.Printf("Sampled %d of %d chunks (%.2f %%), %d chunks untested\n", tested, total, 100.0*float64(tested)/float64(total), untested)
+	if tested == 0 || untested == 0 {
+		return
+	}
+	if bad > 0 {
+		rate := float64(bad) / float64(tested)
+		fmt.Printf("Estimated %.3f %% bad chunks (%d of %d sampled chunks), about %d bad chunks in the untested area\n", 100.0*rate, bad, tested, int64(math.Ceil(rate*float64(untested))))
+		return
+	}
+	upper := 1.0 - math.Pow(1.0-SAMPLE_CONFIDENCE, 1.0/float64(tested))
+	fmt.Printf("With %.0f %% confidence less than %.3f %% of the untested chunks are bad (at most %d chunks), if the defects are spread uniformly\n", confidence, 100.0*upper, int64(math.Ceil(upper*float64(untested))))
+	region := int64(math.Ceil(math.Log(1.0-SAMPLE_CONFIDENCE) / math.Log(1.0-progress.Sample/100.0)))
+	fmt.Printf("A contiguous defect of %s (%d chunks) or more would have been hit with %.0f %% probability\n", gibistr(float32(region*chunkSize)), region, confidence)
+}
@@ -0,0 +1,118 @@
+/* Non-destructive read-only surface scan for disko-san */
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const SLOW_FACTOR = 5                  // Chunks taking this many times the average read time are slow
+const SLOW_MIN = 10 * time.Millisecond // Chunks faster than this are never slow
+const SLOW_WARMUP = 16                 // Number of chunks to read before the average read time is considered
+const SLOW_ALPHA = 0.9                 // Smoothing factor of the average read time
+
+/* Read the whole surface (or the tested range) without writing a single byte.
+ * The content of the disk is unknown, so only read errors count. Every chunk is timed into the performance log, read
+ * errors and slow chunks are recorded in the progress. A chunk is slow, if it takes longer than the given threshold or,
+ * without a threshold, SLOW_FACTOR times the average read time
+ */
+func ScanCheck(disk *Disk, progress *Progress, statsFile string, errorsFile string, budget ErrorBudget, retry RetryPolicy, slow time.Duration) error {
+	var average time.Duration // smoothed read time of the chunks which are not slow
+	chunkSize := int64(progress.ChunkSize)
+	buf := alignedBuffer(int(chunkSize), DIRECT_ALIGNMENT)
+	warmup := SLOW_WARMUP
+	budget.Continue = true // A scan always records all read errors, as long as the error budget allows
+
+	logs, err := OpenStepLogs(statsFile, errorsFile)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+	if retry.Direct {
+		if err := disk.OpenDirect(); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot use direct I/O (%s), retrying with buffered reads\n", err)
+			retry.Direct = false
+		}
+	}
+
+	if progress.Pos == 0 {
+		progress.Pos = progress.RangeStart()
+	}
+	progress.Pos = progress.NextSample(progress.Pos)
+	end := progress.RangeEnd()
+
+	startProgress()
+	for progress.Pos < end {
+		if !running {
+			return fmt.Errorf("interrupted")
+		}
+		size := progress.ChunkSizeAt(progress.Pos) // at the ends of the range, the chunk might be smaller
+		chunk := buf[:size]
+		disk.dropCacheBeforeRead(progress.Pos, size)
+		start := time.Now()
+		n, readErr := disk.ReadAt(chunk, progress.Pos)
+		runtime := time.Since(start)
+		if readErr == nil && int64(n) != size {
+			readErr = fmt.Errorf("short read at %d", progress.Pos)
+		}
+
+		// Write performance stats
+		if err := logs.WriteStats(progress.Pos, size, runtime.Milliseconds()); err != nil {
+			return err
+		}
+
+		if readErr != nil {
+			fmt.Println()
+			fmt.Fprintf(os.Stderr, "Chunk %d read error (disk position %d, LBA %d): %v\n", progress.Pos/chunkSize, progress.Pos, progress.Pos/int64(disk.LogicalSectorSize()), readErr)
+			cerr := NewChunkError(progress.Pos, int(size), int(chunkSize), disk.LogicalSectorSize(), "read-error")
+			cerr.Retries, cerr.Recovered = retryChunk(disk, progress.Pos, chunk, nil, progress.ChunkParams(), &retry)
+			logs.WriteError(cerr)
+			if cerr.Recovered {
+				fmt.Fprintf(os.Stderr, "Chunk %d recovered after %d retries\n", cerr.Chunk, cerr.Retries)
+				progress.Recovered = insertPosition(progress.Recovered, progress.Pos)
+			} else {
+				if cerr.Retries > 0 {
+					fmt.Fprintf(os.Stderr, "Chunk %d still bad after %d retries\n", cerr.Chunk, cerr.Retries)
+				}
+				progress.AddBad(cerr)
+				checked := progress.SampledChunks(progress.RangeStart(), progress.Pos+size)
+				if budget.Exceeded(len(progress.Bad), checked) {
+					progress.WriteIfOpen()
+					return fmt.Errorf("error budget exceeded (%d bad chunks out of %d)", len(progress.Bad), checked)
+				}
+			}
+		} else if (slow > 0 && runtime > slow) || (slow == 0 && warmup <= 0 && runtime > SLOW_MIN && runtime > SLOW_FACTOR*average) {
+			fmt.Println()
+			fmt.Fprintf(os.Stderr, "Chunk %d is slow (disk position %d, LBA %d): %d ms\n", progress.Pos/chunkSize, progress.Pos, progress.Pos/int64(disk.LogicalSectorSize()), runtime.Milliseconds())
+			progress.Slow = insertPosition(progress.Slow, progress.Pos)
+		} else {
+			// Slow chunks don't count, so that a slow region doesn't raise the average
+			if average == 0 {
+				average = runtime
+			} else {
+				average = time.Duration(SLOW_ALPHA*float64(average) + (1.0-SLOW_ALPHA)*float64(runtime))
+			}
+			warmup--
+		}
+
+		// Update progress
+		progress.Pos = progress.NextSample(progress.Pos + size)
+		if err := progress.WriteIfOpen(); err != nil {
+			return fmt.Errorf("Error writing progress file: %s", err)
+		}
+
+		// Print stats
+		throughput := float32(float64(size) / runtime.Seconds())
+		printProgress("Scanning", progress.Percent(), throughput)
+	}
+
+	clearProgress()
+	if len(progress.Bad) > 0 {
+		fmt.Println()
+		return fmt.Errorf("%d unreadable chunks", len(progress.Bad))
+	}
+	fmt.Println("Surface scan successful")
+
+	return nil
+}
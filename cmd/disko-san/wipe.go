@@ -0,0 +1,129 @@
+/* Final wipe of the disk after a successful test for disko-san */
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const DISCARD_STEP = 1024 * 1024 * 1024 // Discard the disk in steps of 1 GiB, so that the progress can be tracked
+
+// Wipe modes
+var WIPE_MODES = []string{"zero", "discard", "clear"}
+
+func ParseWipeMode(str string) (string, error) {
+	for _, mode := range WIPE_MODES {
+		if str == mode {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("invalid wipe mode '%s' (zero, discard or clear)", str)
+}
+
+/* Wipe the tested range of the disk after a successful test according to progress.Wipe:
+ * "zero" writes and verifies zeros, "discard" discards the range and "clear" only clears the run header.
+ * The first chunk with the run header is cleared last, so that an interrupted wipe can be resumed.
+ * Warning: This is a destructive function!
+ */
+func Wipe(disk *Disk, progress *Progress) error {
+	chunkSize := int64(progress.ChunkSize)
+	end := progress.RangeEnd()
+	if progress.Pos < progress.RangeStart() {
+		progress.Pos = progress.RangeStart() // The first chunk comes last
+	}
+
+	switch progress.Wipe {
+	case "zero":
+		if err := zeroFill(disk, progress); err != nil {
+			return err
+		}
+	case "discard":
+		for progress.Pos < end {
+			if !running {
+				return fmt.Errorf("interrupted")
+			}
+			size := int64(DISCARD_STEP)
+			if progress.Pos+size > end {
+				size = end - progress.Pos
+			}
+			if err := disk.Discard(progress.Pos, size); err != nil {
+				// Zeros leave no test data behind either, so a disk without discard support isn't stuck
+				fmt.Fprintf(os.Stderr, "Warning: discard error at %d (%s), zeroing the rest of the disk instead\n", progress.Pos, err)
+				progress.Wipe = "zero"
+				if err := progress.WriteIfOpen(); err != nil {
+					return fmt.Errorf("Error writing progress file: %s", err)
+				}
+				return Wipe(disk, progress)
+			}
+			progress.Pos += size
+			if err := progress.WriteIfOpen(); err != nil {
+				return fmt.Errorf("Error writing progress file: %s", err)
+			}
+		}
+	case "clear":
+	default:
+		return fmt.Errorf("invalid wipe mode '%s'", progress.Wipe)
+	}
+	progress.Pos = end
+	if err := progress.WriteIfOpen(); err != nil {
+		return fmt.Errorf("Error writing progress file: %s", err)
+	}
+
+	// Clear the first chunk with the run header
+	size := chunkSize
+	if size > progress.Size {
+		size = progress.Size
+	}
+	if _, err := disk.WriteAt(alignedBuffer(int(size), DIRECT_ALIGNMENT), 0); err != nil {
+		return fmt.Errorf("write error at 0: %s", err)
+	}
+	if err := disk.Sync(); err != nil {
+		return err
+	}
+	fmt.Printf("Disk wiped (%s)\n", progress.Wipe)
+	return nil
+}
+
+// Fill the disk with zeros and read every chunk back to verify it
+func zeroFill(disk *Disk, progress *Progress) error {
+	chunkSize := int64(progress.ChunkSize)
+	end := progress.RangeEnd()
+	zeros := alignedBuffer(int(chunkSize), DIRECT_ALIGNMENT)
+	chunk := alignedBuffer(int(chunkSize), DIRECT_ALIGNMENT)
+
+	startProgress()
+	for progress.Pos < end {
+		if !running {
+			return fmt.Errorf("interrupted")
+		}
+		size := progress.ChunkSizeAt(progress.Pos)
+		start := time.Now()
+		if _, err := disk.WriteAt(zeros[:size], progress.Pos); err != nil {
+			return fmt.Errorf("write error at %d: %s", progress.Pos, err)
+		}
+		if err := disk.Sync(); err != nil {
+			return err
+		}
+		disk.dropCacheBeforeRead(progress.Pos, size)
+		if n, err := disk.ReadAt(chunk[:size], progress.Pos); err != nil {
+			return fmt.Errorf("read error at %d: %s", progress.Pos, err)
+		} else if int64(n) != size {
+			return fmt.Errorf("short read at %d", progress.Pos)
+		}
+		if !isZero(chunk[:size]) {
+			return fmt.Errorf("chunk at %d is not zero after wiping", progress.Pos)
+		}
+		runtime := time.Since(start)
+
+		progress.Pos += size
+		if err := progress.WriteIfOpen(); err != nil {
+			return fmt.Errorf("Error writing progress file: %s", err)
+		}
+
+		throughput := float32(float64(size) / runtime.Seconds())
+		printProgress("Zeroing", progress.Percent(), throughput)
+	}
+	clearProgress()
+	return nil
+}